@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bkohler/procnetmon2/internal/output"
+	"github.com/spf13/cobra"
+)
+
+// runEvents streams connection lifecycle events of the monitored processes,
+// one per line, until interrupted
+func runEvents(cmd *cobra.Command, args []string) error {
+	procMon, bpfMon, err := startMonitors(true, false)
+	if err != nil {
+		return err
+	}
+	defer bpfMon.Stop()
+	defer procMon.Stop()
+
+	formatter := output.New(output.Config{
+		JSONOutput: jsonOutput,
+	})
+
+	// Setup signal handling for clean shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	events := bpfMon.Events()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			fmt.Print(formatter.FormatEvent(ev))
+		case <-sigChan:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bkohler/procnetmon2/internal/collector"
+	"github.com/bkohler/procnetmon2/internal/output"
+	"github.com/bkohler/procnetmon2/internal/process"
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+// exitStatsTimeout bounds the wait for the final statistics of the command
+// once it has exited. Commands without traffic leave no exit record; the
+// process monitor notices they are gone within a second.
+const exitStatsTimeout = 2 * time.Second
+
+// runCommand runs a command under monitoring and prints the network usage
+// of it and its descendants to stderr when it exits. The tool exits with the
+// exit code of the command.
+func runCommand(cmd *cobra.Command, args []string) error {
+	grouping, err := output.ParseGroupBy(groupBy)
+	if err != nil {
+		return err
+	}
+
+	procMon, bpfMon, err := startMonitors(false, true)
+	if err != nil {
+		return err
+	}
+	defer bpfMon.Stop()
+	defer procMon.Stop()
+
+	collector := collector.New(bpfMon, procMon, collector.Config{
+		SampleInterval: time.Second,
+		WindowSize:     10,
+		Continuous:     true,
+		AccountAll:     accountAll,
+	})
+	if err := collector.Start(); err != nil {
+		return fmt.Errorf("failed to start collector: %w", err)
+	}
+	defer collector.Stop()
+
+	// Interrupts from the terminal reach the command too, which decides
+	// whether to exit; termination requests are passed on to it
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	child := exec.Command(args[0], args[1:]...)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	if err := procMon.Launch(child); err != nil {
+		return fmt.Errorf("failed to run %s: %w", args[0], err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- child.Wait()
+	}()
+
+	var waitErr error
+wait:
+	for {
+		select {
+		case waitErr = <-done:
+			break wait
+		case sig := <-sigChan:
+			if sig == syscall.SIGTERM {
+				child.Process.Signal(sig)
+			}
+		}
+	}
+
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		return fmt.Errorf("failed to wait for %s: %w", args[0], waitErr)
+	}
+	exitCode = commandExitCode(child.ProcessState)
+
+	waitForExit(procMon, int32(child.Process.Pid))
+
+	formatter := output.New(output.Config{
+		JSONOutput:     jsonOutput,
+		UseColor:       !jsonOutput && isatty.IsTerminal(os.Stderr.Fd()),
+		ShowDetails:    showDetails,
+		ShowDNS:        showDNS,
+		ShowHTTP:       showHTTP,
+		ShowHistograms: showHist,
+		GroupBy:        grouping,
+	})
+	fmt.Fprint(os.Stderr, formatter.FormatStats(procMon.GetAllStats()))
+	return nil
+}
+
+// waitForExit waits until the process monitor holds the final statistics of
+// an exited process, or exitStatsTimeout has passed
+func waitForExit(procMon *process.Monitor, pid int32) {
+	deadline := time.Now().Add(exitStatsTimeout)
+	for time.Now().Before(deadline) {
+		procStats, err := procMon.GetProcessStats(pid)
+		if err != nil {
+			return
+		}
+		if _, exited := procStats.Exited(); exited {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// commandExitCode returns the exit code of a command the way shells report
+// it, as 128 plus the signal number for commands killed by a signal
+func commandExitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
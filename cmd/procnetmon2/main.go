@@ -10,23 +10,56 @@ import (
 
 	"github.com/bkohler/procnetmon2/internal/bpf"
 	"github.com/bkohler/procnetmon2/internal/collector"
+	"github.com/bkohler/procnetmon2/internal/container"
 	"github.com/bkohler/procnetmon2/internal/output"
 	"github.com/bkohler/procnetmon2/internal/process"
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 )
 
 var (
 	// CLI flags
 	pids        []string
-	interface_  string
+	comms       []string
+	cmdline     string
+	exes        []string
+	uids        []string
+	cgroups     []string
+	units       []string
+	containers  []string
+	runtimeSock string
+	criSock     string
+	interfaces  []string
+	attribution string
+	accounting  string
+	decapsulate bool
+	accountAll  bool
 	jsonOutput  bool
 	sampleTime  string
 	aggregate   bool
 	continuous  bool
 	showDetails bool
+	showDNS     bool
+	showHTTP    bool
+	showTLS     bool
+	showHist    bool
+	groupBy     string
+
+	// exitCode is the exit code of the tool, that of the command for run
+	exitCode int
 )
 
 func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(exitCode)
+}
+
+// newRootCmd creates the command line, binding its flags to the variables
+// above
+func newRootCmd() *cobra.Command {
 	rootCmd := &cobra.Command{
 		Use:   "procnetmon2",
 		Short: "Process-specific network monitoring tool using eBPF",
@@ -36,22 +69,57 @@ insights into network usage with minimal system overhead.`,
 		RunE: run,
 	}
 
+	eventsCmd := &cobra.Command{
+		Use:   "events",
+		Short: "Stream connect, accept and close events of the monitored processes",
+		RunE:  runEvents,
+	}
+	rootCmd.AddCommand(eventsCmd)
+
+	runCmd := &cobra.Command{
+		Use:   "run [flags] -- command [args...]",
+		Short: "Run a command and report the network usage of it and its descendants",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runCommand,
+	}
+	// Flags after the command name belong to the command
+	runCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(runCmd)
+
+	// Add flags shared with subcommands
+	rootCmd.PersistentFlags().StringSliceVarP(&pids, "pids", "p", []string{}, "Comma-separated list of process IDs to monitor")
+	rootCmd.PersistentFlags().StringSliceVar(&comms, "comm", []string{}, "Monitor processes with these names; accepts globs")
+	rootCmd.PersistentFlags().StringVar(&cmdline, "cmdline", "", "Monitor processes whose command line matches this regular expression")
+	rootCmd.PersistentFlags().StringSliceVar(&exes, "exe", []string{}, "Monitor processes running these executables; accepts globs")
+	rootCmd.PersistentFlags().StringSliceVar(&uids, "uid", []string{}, "Monitor processes running as these user IDs")
+	rootCmd.PersistentFlags().StringSliceVar(&cgroups, "cgroup", []string{}, "Monitor all processes in these cgroup v2 paths, one row each")
+	rootCmd.PersistentFlags().StringSliceVar(&units, "unit", []string{}, "Monitor all processes of these systemd units, one row each")
+	rootCmd.PersistentFlags().StringSliceVar(&containers, "container", []string{}, "Monitor all processes of these containers, by name or ID, one row each")
+	rootCmd.PersistentFlags().StringVar(&runtimeSock, "runtime-socket", "/var/run/docker.sock", "Docker Engine API socket to look up container names, images and labels (empty to disable)")
+	rootCmd.PersistentFlags().StringVar(&criSock, "cri-socket", "/run/containerd/containerd.sock", "CRI runtime socket to look up Kubernetes pods and their containers (empty to disable)")
+	rootCmd.PersistentFlags().StringSliceVarP(&interfaces, "interface", "i", []string{}, "Network interfaces to monitor; accepts globs (eth*) and exclusions (!lo) (default: all)")
+	rootCmd.PersistentFlags().StringVar(&attribution, "attribution", "tree", "Account traffic of descendants to the monitored process (tree) or per process (process)")
+	rootCmd.PersistentFlags().StringVar(&accounting, "accounting", "wire", "Count traffic on the wire (wire), as socket payload (socket) or both (both)")
+	rootCmd.PersistentFlags().BoolVar(&decapsulate, "decap", false, "Account the inner flows of VXLAN, Geneve and GRE packets instead of the tunnel")
+	rootCmd.PersistentFlags().BoolVar(&accountAll, "account-all", false, "Account and show every process with traffic, not only the selected ones")
+	rootCmd.PersistentFlags().BoolVarP(&jsonOutput, "json", "j", false, "Output in JSON format (NDJSON for events)")
+
 	// Add flags
-	rootCmd.Flags().StringSliceVarP(&pids, "pids", "p", []string{}, "Comma-separated list of process IDs to monitor")
-	rootCmd.Flags().StringVarP(&interface_, "interface", "i", "", "Network interface to monitor (default: all)")
-	rootCmd.Flags().BoolVarP(&jsonOutput, "json", "j", false, "Output in JSON format")
 	rootCmd.Flags().StringVarP(&sampleTime, "time", "t", "", "Time-based sampling period (e.g., 60s, 5m)")
 	rootCmd.Flags().BoolVarP(&aggregate, "aggregate", "a", false, "Aggregate statistics across monitored processes")
 	rootCmd.Flags().BoolVarP(&continuous, "continuous", "c", true, "Enable continuous monitoring")
-	rootCmd.Flags().BoolVarP(&showDetails, "details", "d", false, "Show detailed connection information")
-
-	// Make pids required
-	rootCmd.MarkFlagRequired("pids")
 
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	// Add flags selecting what statistics to show
+	for _, c := range []*cobra.Command{rootCmd, runCmd} {
+		c.Flags().BoolVarP(&showDetails, "details", "d", false, "Show detailed connection information")
+		c.Flags().BoolVar(&showDNS, "dns", false, "Log DNS queries of the monitored processes (requires wire accounting)")
+		c.Flags().BoolVar(&showHist, "histograms", false, "Show packet size and inter-arrival histograms (requires wire accounting)")
+		c.Flags().BoolVar(&showHTTP, "http", false, "Sniff plaintext HTTP/1.x requests and responses (requires wire accounting)")
+		c.Flags().BoolVar(&showTLS, "tls", false, "Record TLS server names (SNI) of outgoing connections (requires wire accounting)")
+		c.Flags().StringVar(&groupBy, "group-by", "", "Combine rows per Kubernetes pod, namespace or container (pod, namespace or container)")
 	}
+
+	return rootCmd
 }
 
 func run(cmd *cobra.Command, args []string) error {
@@ -64,36 +132,24 @@ func run(cmd *cobra.Command, args []string) error {
 			return fmt.Errorf("invalid sampling time format: %w", err)
 		}
 	}
-
-	// Initialize process monitor
-	procMon := process.New()
-
-	// Add processes to monitor
-	for _, pidStr := range pids {
-		if err := procMon.AddProcess(pidStr); err != nil {
-			return fmt.Errorf("failed to add process %s: %w", pidStr, err)
-		}
+	grouping, err := output.ParseGroupBy(groupBy)
+	if err != nil {
+		return err
 	}
 
-	// Initialize eBPF monitor
-	bpfMon, err := bpf.New(bpf.Config{
-		Interface: interface_,
-	})
+	procMon, bpfMon, err := startMonitors(false, false)
 	if err != nil {
-		return fmt.Errorf("failed to initialize eBPF monitor: %w", err)
+		return err
 	}
 	defer bpfMon.Stop()
-
-	// Start eBPF monitoring
-	if err := bpfMon.Start(); err != nil {
-		return fmt.Errorf("failed to start eBPF monitor: %w", err)
-	}
+	defer procMon.Stop()
 
 	// Initialize statistics collector
 	collector := collector.New(bpfMon, procMon, collector.Config{
 		SampleInterval: time.Second,
 		WindowSize:     10,
 		Continuous:     continuous,
+		AccountAll:     accountAll,
 	})
 
 	// Start collection
@@ -104,9 +160,13 @@ func run(cmd *cobra.Command, args []string) error {
 
 	// Initialize output formatter
 	formatter := output.New(output.Config{
-		JSONOutput:  jsonOutput,
-		UseColor:    !jsonOutput && os.Stdout.Fd() == 1, // Use color if not JSON and stdout is a terminal
-		ShowDetails: showDetails,
+		JSONOutput:     jsonOutput,
+		UseColor:       !jsonOutput && isatty.IsTerminal(os.Stdout.Fd()), // Use color if not JSON and stdout is a terminal
+		ShowDetails:    showDetails,
+		ShowDNS:        showDNS,
+		ShowHTTP:       showHTTP,
+		ShowHistograms: showHist,
+		GroupBy:        grouping,
 	})
 
 	// Setup signal handling for clean shutdown
@@ -119,10 +179,11 @@ func run(cmd *cobra.Command, args []string) error {
 
 	// Start monitoring loop
 	fmt.Printf("Starting network monitoring...\n")
-	if interface_ != "" {
-		fmt.Printf("Filtering on interface: %s\n", interface_)
+	if len(interfaces) > 0 {
+		fmt.Printf("Filtering on interfaces: %s\n", strings.Join(interfaces, ", "))
 	}
-	fmt.Printf("Monitoring PIDs: %s\n\n", strings.Join(pids, ", "))
+	fmt.Printf("Monitoring interfaces: %s\n", strings.Join(bpfMon.Interfaces(), ", "))
+	fmt.Printf("Monitoring PIDs: %v\n\n", procMon.GetMonitoredPIDs())
 
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
@@ -149,3 +210,107 @@ func run(cmd *cobra.Command, args []string) error {
 		}
 	}
 }
+
+// startMonitors sets up process monitoring for the PIDs and selectors given
+// on the command line and starts the eBPF monitor, optionally with
+// connection events. With launch, the caller adds the processes it starts
+// itself, so none need to be selected. The caller must stop both returned
+// monitors.
+func startMonitors(events, launch bool) (*process.Monitor, *bpf.NetworkMonitor, error) {
+	cfg, err := bpfConfig(events)
+	if err != nil {
+		return nil, nil, err
+	}
+	if launch && cfg.Attribution != bpf.AttributeTree {
+		return nil, nil, fmt.Errorf("run accounts descendants to the command; attribution %q is not supported", attribution)
+	}
+
+	sel, err := process.NewSelector(comms, cmdline, exes, uids)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !launch && !accountAll && len(pids) == 0 && sel.Empty() && len(cgroups) == 0 && len(units) == 0 && len(containers) == 0 {
+		return nil, nil, fmt.Errorf("no processes selected: give --pids, --comm, --cmdline, --exe, --uid, --cgroup, --unit, --container or --account-all")
+	}
+
+	// Initialize process monitor, labelling processes with their containers
+	procMon := process.New()
+	procMon.SetContainerResolver(container.NewResolver(runtimeSock, criSock))
+	if !sel.Empty() {
+		procMon.AddSelector(sel)
+	}
+
+	// Add processes to monitor
+	for _, pidStr := range pids {
+		if err := procMon.AddProcess(pidStr); err != nil {
+			return nil, nil, fmt.Errorf("failed to add process %s: %w", pidStr, err)
+		}
+	}
+
+	// Add cgroups and units to monitor as a whole
+	for _, path := range cgroups {
+		if err := procMon.AddCgroup(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, name := range units {
+		if err := procMon.AddUnit(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, ref := range containers {
+		if err := procMon.AddContainer(ref); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Initialize eBPF monitor
+	bpfMon, err := bpf.New(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to initialize eBPF monitor: %w", err)
+	}
+
+	// Only account traffic of the monitored processes in the kernel
+	if err := procMon.SetPIDFilter(bpfMon); err != nil {
+		bpfMon.Stop()
+		return nil, nil, fmt.Errorf("failed to initialize PID filter: %w", err)
+	}
+
+	// Start eBPF monitoring
+	if err := bpfMon.Start(); err != nil {
+		bpfMon.Stop()
+		return nil, nil, fmt.Errorf("failed to start eBPF monitor: %w", err)
+	}
+
+	// Pick up matching processes, now and as they start
+	procMon.Start()
+
+	return procMon, bpfMon, nil
+}
+
+// bpfConfig builds the eBPF monitor configuration from the command line,
+// optionally with connection events
+func bpfConfig(events bool) (bpf.Config, error) {
+	mode, err := bpf.ParseAttribution(attribution)
+	if err != nil {
+		return bpf.Config{}, err
+	}
+	layers, err := bpf.ParseAccounting(accounting)
+	if err != nil {
+		return bpf.Config{}, err
+	}
+
+	return bpf.Config{
+		Interfaces:  interfaces,
+		AccountAll:  accountAll,
+		Attribution: mode,
+		Events:      events,
+		Accounting:  layers,
+		DNS:         showDNS,
+		HTTP:        showHTTP,
+		TLS:         showTLS,
+		Histograms:  showHist,
+		Decapsulate: decapsulate,
+		Cgroups:     len(cgroups) > 0 || len(units) > 0 || len(containers) > 0,
+	}, nil
+}
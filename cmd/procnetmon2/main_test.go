@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAccountAllFlag(t *testing.T) {
+	for _, args := range [][]string{{"--account-all"}, {"run", "--account-all", "--", "true"}} {
+		accountAll = false
+		cmd := newRootCmd()
+		sub, rest, err := cmd.Find(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sub.ParseFlags(rest); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+
+		cfg, err := bpfConfig(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.AccountAll {
+			t.Errorf("%v: AccountAll not set", args)
+		}
+	}
+
+	accountAll = false
+	if cfg, _ := bpfConfig(false); cfg.AccountAll {
+		t.Error("AccountAll set without --account-all")
+	}
+}
+
+func TestTLSFlag(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		showTLS = false
+		args := []string{"--pids", "1"}
+		if tls {
+			args = append(args, "--tls")
+		}
+		if err := newRootCmd().ParseFlags(args); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := bpfConfig(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.TLS != tls {
+			t.Errorf("%v: TLS = %v", args, cfg.TLS)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Legacy cls_bpf filters are named after their hook and the PID of the
+// process that added them, e.g. "procnetmon2_ingress_1234", so that filters
+// left behind by a run that did not exit cleanly can be told apart from
+// those of other running instances
+const (
+	legacyIngressName    = "procnetmon2_ingress"
+	legacyEgressName     = "procnetmon2_egress"
+	legacyFilterPriority = 0xc000 // First priority tried for legacy filters
+)
+
+// interface_filter flags
+const (
+	ifaceMonitored = 0x01 // Traffic is accounted
+	ifaceRawIP     = 0x02 // No link-layer header; packets start with IP
+)
+
+// tcAttachment holds the TC programs attached to one interface
+type tcAttachment struct {
+	name    string
+	index   int
+	links   []link.Link           // TCX links
+	filters []*netlink.BpfFilter  // Legacy cls_bpf filters
+	qdisc   *netlink.GenericQdisc // clsact qdisc, if it was added by us
+}
+
+// attachInterface attaches the TC programs to a single interface. TCX links
+// are used where the kernel supports them; otherwise cls_bpf filters are
+// added next to any existing ones.
+func (nm *NetworkMonitor) attachInterface(iface netlink.Link) error {
+	attrs := iface.Attrs()
+	att := &tcAttachment{
+		name:  attrs.Name,
+		index: attrs.Index,
+	}
+
+	err := att.attachTCX(nm.programs)
+	if errors.Is(err, ebpf.ErrNotSupported) {
+		err = att.attachLegacy(nm.programs)
+	}
+	if err != nil {
+		att.detach()
+		return fmt.Errorf("failed to attach to %s: %w", attrs.Name, err)
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.closed {
+		att.detach()
+		return nil
+	}
+	if old, ok := nm.attached[attrs.Index]; ok {
+		old.detach()
+	}
+	nm.attached[attrs.Index] = att
+
+	// Enable monitoring for this interface
+	if err := nm.maps.InterfaceFilter.Put(uint32(attrs.Index), ifaceFlags(attrs)); err != nil {
+		return fmt.Errorf("failed to update interface filter: %w", err)
+	}
+	return nil
+}
+
+// ifaceFlags returns the interface_filter flags of a monitored interface.
+// Only Ethernet and loopback devices carry a link-layer header the kernel
+// program can parse; tun, WireGuard, IP-in-IP and GRE devices hand it bare
+// IP packets.
+func ifaceFlags(attrs *netlink.LinkAttrs) uint8 {
+	switch attrs.EncapType {
+	case "ether", "loopback", "":
+		return ifaceMonitored
+	default:
+		return ifaceMonitored | ifaceRawIP
+	}
+}
+
+// attachTCX attaches the TC programs as TCX links. The links are
+// deliberately not pinned: the kernel detaches them as soon as their file
+// descriptors are closed, which includes the process crashing or being
+// killed, so none are left behind to recover.
+func (att *tcAttachment) attachTCX(progs *netmonPrograms) error {
+	for _, hook := range []struct {
+		prog   *ebpf.Program
+		attach ebpf.AttachType
+	}{
+		{progs.TcIngress, ebpf.AttachTCXIngress},
+		{progs.TcEgress, ebpf.AttachTCXEgress},
+	} {
+		l, err := link.AttachTCX(link.TCXOptions{
+			Interface: att.index,
+			Program:   hook.prog,
+			Attach:    hook.attach,
+		})
+		if err != nil {
+			return err
+		}
+		att.links = append(att.links, l)
+	}
+	return nil
+}
+
+// attachLegacy attaches the TC programs as cls_bpf filters on a clsact qdisc.
+// An existing qdisc is shared, never replaced, and the filters use the first
+// priority not taken by other filters on the same hook.
+func (att *tcAttachment) attachLegacy(progs *netmonPrograms) error {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: att.index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(qdisc); err == nil {
+		att.qdisc = qdisc
+	} else if !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("failed to add qdisc: %w", err)
+	}
+
+	for _, hook := range []struct {
+		prog   *ebpf.Program
+		parent uint32
+		name   string
+	}{
+		{progs.TcIngress, netlink.HANDLE_MIN_INGRESS, legacyFilterName(legacyIngressName, os.Getpid())},
+		{progs.TcEgress, netlink.HANDLE_MIN_EGRESS, legacyFilterName(legacyEgressName, os.Getpid())},
+	} {
+		priority, err := att.freePriority(hook.parent, hook.name)
+		if err != nil {
+			return err
+		}
+
+		filter := &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: att.index,
+				Parent:    hook.parent,
+				Handle:    netlink.MakeHandle(0, 1),
+				Priority:  priority,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Fd:           hook.prog.FD(),
+			Name:         hook.name,
+			DirectAction: true,
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return fmt.Errorf("failed to add %s filter: %w", hook.name, err)
+		}
+		att.filters = append(att.filters, filter)
+	}
+	return nil
+}
+
+// legacyFilterName returns the name of the filter process pid adds to a hook
+func legacyFilterName(hook string, pid int) string {
+	return hook + "_" + strconv.Itoa(pid)
+}
+
+// staleFilter reports whether f is a legacy filter added by a process that
+// is no longer running
+func staleFilter(f netlink.Filter) bool {
+	bpf, ok := f.(*netlink.BpfFilter)
+	if !ok {
+		return false
+	}
+	for _, hook := range []string{legacyIngressName, legacyEgressName} {
+		suffix, ok := strings.CutPrefix(bpf.Name, hook+"_")
+		if !ok {
+			continue
+		}
+		pid, err := strconv.Atoi(suffix)
+		if err != nil || pid <= 0 {
+			return false
+		}
+		// EPERM means the process exists but belongs to someone else
+		return errors.Is(unix.Kill(pid, 0), unix.ESRCH)
+	}
+	return false
+}
+
+// removeStaleFilters removes the legacy filters left on the given links by
+// runs that did not exit cleanly. Unlike TCX links, cls_bpf filters outlive
+// the process that added them. Filters of other running instances are kept,
+// and a clsact qdisc added by a crashed run is left in place, as other tools
+// may have come to use it.
+func removeStaleFilters(links []netlink.Link) {
+	for _, l := range links {
+		for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+			filters, err := netlink.FilterList(l, parent)
+			if err != nil {
+				continue // No clsact qdisc
+			}
+			for _, f := range filters {
+				if staleFilter(f) {
+					netlink.FilterDel(f)
+				}
+			}
+		}
+	}
+}
+
+// freePriority removes our own filter named name and stale filters from a
+// TC hook and returns the first priority not used by the remaining filters
+func (att *tcAttachment) freePriority(parent uint32, name string) (uint16, error) {
+	filters, err := netlink.FilterList(att.link(), parent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list filters: %w", err)
+	}
+
+	used := make(map[uint16]bool)
+	for _, f := range filters {
+		if bpf, ok := f.(*netlink.BpfFilter); (ok && bpf.Name == name) || staleFilter(f) {
+			netlink.FilterDel(f)
+			continue
+		}
+		used[f.Attrs().Priority] = true
+	}
+
+	priority := uint16(legacyFilterPriority)
+	for used[priority] {
+		priority++
+	}
+	return priority, nil
+}
+
+// detach removes everything attachInterface added to the interface
+func (att *tcAttachment) detach() {
+	for _, l := range att.links {
+		l.Close()
+	}
+	att.links = nil
+
+	for _, f := range att.filters {
+		netlink.FilterDel(f)
+	}
+	att.filters = nil
+
+	// Only remove a qdisc we added, and only if nobody else uses it by now
+	if att.qdisc != nil {
+		ingress, _ := netlink.FilterList(att.link(), netlink.HANDLE_MIN_INGRESS)
+		egress, _ := netlink.FilterList(att.link(), netlink.HANDLE_MIN_EGRESS)
+		if len(ingress) == 0 && len(egress) == 0 {
+			netlink.QdiscDel(att.qdisc)
+		}
+		att.qdisc = nil
+	}
+}
+
+// link returns a handle for netlink calls that only need the interface index
+func (att *tcAttachment) link() netlink.Link {
+	return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: att.index, Name: att.name}}
+}
+
+// detachInterface detaches the TC programs from the interface with the given
+// index, if attached, and stops accounting its traffic
+func (nm *NetworkMonitor) detachInterface(index int) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if att, ok := nm.attached[index]; ok {
+		att.detach()
+		delete(nm.attached, index)
+		nm.maps.InterfaceFilter.Delete(uint32(index))
+	}
+}
+
+// detachAll detaches the TC programs from every interface
+func (nm *NetworkMonitor) detachAll() {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	nm.closed = true
+	for index, att := range nm.attached {
+		att.detach()
+		delete(nm.attached, index)
+	}
+}
+
+// attachInterfaces attaches the TC programs to every selected interface and
+// keeps following interfaces as they are created, renamed and removed.
+// Interfaces matched by a pattern, or by default, that cannot be
+// instrumented are skipped with a log message; interfaces given by name
+// must attach, as must at least one interface.
+func (nm *NetworkMonitor) attachInterfaces() error {
+	// Subscribe before listing so links created in between are not missed
+	updates := make(chan netlink.LinkUpdate)
+	nm.linkDone = make(chan struct{})
+	if err := netlink.LinkSubscribe(updates, nm.linkDone); err != nil {
+		return fmt.Errorf("failed to subscribe to link updates: %w", err)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	removeStaleFilters(links)
+
+	var skipped []error
+	for _, iface := range links {
+		if !nm.wantInterface(iface) {
+			continue
+		}
+		if err := nm.attachInterface(iface); err != nil {
+			if nm.selector.named(iface.Attrs().Name) {
+				return err
+			}
+			skipped = append(skipped, err)
+		}
+	}
+	if len(skipped) > 0 && len(nm.Interfaces()) == 0 {
+		return errors.Join(skipped...)
+	}
+	for _, err := range skipped {
+		log.Printf("skipping interface: %v", err)
+	}
+
+	go nm.watchLinks(updates)
+	return nil
+}
+
+// watchLinks follows link updates until the subscription is closed
+func (nm *NetworkMonitor) watchLinks(updates <-chan netlink.LinkUpdate) {
+	for update := range updates {
+		index := update.Attrs().Index
+
+		switch update.Header.Type {
+		case unix.RTM_NEWLINK:
+			// Also sent for changes to existing links. A renamed link may
+			// have left or joined the selection, and its attachment is
+			// under the old name; it is detached and attached anew.
+			nm.mu.Lock()
+			att, ok := nm.attached[index]
+			nm.mu.Unlock()
+			if ok && att.name == update.Attrs().Name {
+				continue
+			}
+			if ok {
+				nm.detachInterface(index)
+			}
+			if nm.wantInterface(update.Link) {
+				if err := nm.attachInterface(update.Link); err != nil {
+					log.Printf("skipping interface: %v", err)
+				}
+			}
+		case unix.RTM_DELLINK:
+			// The kernel removes the hooks along with the link; release
+			// what is left on our side
+			nm.detachInterface(index)
+		}
+	}
+}
+
+// wantInterface reports whether an interface is selected and not attached yet
+func (nm *NetworkMonitor) wantInterface(iface netlink.Link) bool {
+	attrs := iface.Attrs()
+	if !nm.selector.Match(attrs.Name) {
+		return false
+	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	_, ok := nm.attached[attrs.Index]
+	return !ok
+}
+
+// getInterfaceStats returns the per-interface counters of a process for the
+// currently instrumented interfaces
+func (nm *NetworkMonitor) getInterfaceStats(pid uint32) (map[string]types.TrafficStats, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	ifaces := make(map[string]types.TrafficStats)
+	for index, att := range nm.attached {
+		var percpu []netmonTrafficStats
+		key := netmonIfaceKey{Pid: pid, Ifindex: uint32(index)}
+		if err := nm.maps.IfaceStats.Lookup(&key, &percpu); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to lookup interface stats: %w", err)
+		}
+		var stats netmonTrafficStats
+		for i := range percpu {
+			addTrafficStats(&stats, &percpu[i])
+		}
+		ifaces[att.name] = trafficStats(&stats)
+	}
+	return ifaces, nil
+}
+
+// Interfaces returns the names of the currently instrumented interfaces
+func (nm *NetworkMonitor) Interfaces() []string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	names := make([]string, 0, len(nm.attached))
+	for _, att := range nm.attached {
+		names = append(names, att.name)
+	}
+	sort.Strings(names)
+	return names
+}
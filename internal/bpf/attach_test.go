@@ -0,0 +1,115 @@
+package bpf
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestIfaceFlags(t *testing.T) {
+	tests := []struct {
+		encap    string
+		expected uint8
+	}{
+		{"ether", ifaceMonitored},
+		{"loopback", ifaceMonitored},
+		{"none", ifaceMonitored | ifaceRawIP}, // tun, WireGuard
+		{"ipip", ifaceMonitored | ifaceRawIP},
+		{"gre", ifaceMonitored | ifaceRawIP},
+	}
+	for _, test := range tests {
+		if got := ifaceFlags(&netlink.LinkAttrs{EncapType: test.encap}); got != test.expected {
+			t.Errorf("ifaceFlags(%s) = %#x; expected %#x", test.encap, got, test.expected)
+		}
+	}
+}
+
+func TestRemoveStaleFilters(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "pnm-stale0"},
+		PeerName:  "pnm-stale1",
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Fatalf("failed to create veth pair: %v", err)
+	}
+	defer netlink.LinkDel(veth)
+	iface, err := netlink.LinkByName(veth.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.SchedCLS,
+		License:      "GPL",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 0), asm.Return()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prog.Close()
+
+	// A process that has exited, for a filter left by a crashed run
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Next to the filters of a running instance and of another tool
+	index := iface.Attrs().Index
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{
+		legacyFilterName(legacyIngressName, exited.Process.Pid),
+		legacyFilterName(legacyIngressName, os.Getpid()),
+		"other",
+	} {
+		filter := &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: index,
+				Parent:    netlink.HANDLE_MIN_INGRESS,
+				Handle:    netlink.MakeHandle(0, 1),
+				Priority:  uint16(legacyFilterPriority + i),
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Fd:           prog.FD(),
+			Name:         name,
+			DirectAction: true,
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeStaleFilters([]netlink.Link{iface})
+
+	filters, err := netlink.FilterList(iface, netlink.HANDLE_MIN_INGRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("Expected the running instance's and the other filter to remain, got %+v", filters)
+	}
+	for _, f := range filters {
+		if name := f.(*netlink.BpfFilter).Name; name == legacyFilterName(legacyIngressName, exited.Process.Pid) {
+			t.Errorf("Stale filter %s was not removed", name)
+		}
+	}
+}
@@ -2,35 +2,260 @@
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_endian.h>
 #include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
 
 // Protocol definitions
 #define ETH_P_IP    0x0800      /* Internet Protocol packet */
+#define ETH_P_IPV6  0x86DD      /* IPv6 over bluebook */
+#define ETH_P_8021Q 0x8100      /* 802.1Q VLAN Extended Header */
+#define ETH_P_8021AD 0x88A8     /* 802.1ad Service VLAN */
+#define ETH_P_TEB   0x6558      /* Trans Ether Bridging */
 #define IPPROTO_TCP 6           /* Transmission Control Protocol */
 #define IPPROTO_UDP 17          /* User Datagram Protocol */
+#define IPPROTO_GRE 47          /* Generic Routing Encapsulation */
 
-// Map to store process network statistics
+// VLAN tags walked before giving up; two for QinQ
+#define VLAN_MAX_DEPTH  2
+
+// Tunnels
+#define VXLAN_PORT      4789
+#define GENEVE_PORT     6081
+#define GRE_CSUM        0x8000
+#define GRE_KEY         0x2000
+#define GRE_SEQ         0x1000
+#define GRE_VERSION     0x0007
+
+// interface_filter flags
+#define IFACE_MONITORED 0x01    /* Traffic is accounted */
+#define IFACE_RAW_IP    0x02    /* No link-layer header, e.g. tun or WireGuard */
+
+// IPv6 extension headers
+#define NEXTHDR_HOP         0   /* Hop-by-hop option header */
+#define NEXTHDR_ROUTING     43  /* Routing header */
+#define NEXTHDR_FRAGMENT    44  /* Fragmentation/reassembly header */
+#define NEXTHDR_AUTH        51  /* Authentication header */
+#define NEXTHDR_DEST        60  /* Destination options header */
+#define IPV6_EXT_MAX        8   /* Extension headers walked before giving up */
+
+// TCP states (include/net/tcp_states.h)
+#define TCP_ESTABLISHED     1
+#define TCP_SYN_SENT        2
+#define TCP_SYN_RECV        3
+#define TCP_FIN_WAIT1       4
+#define TCP_FIN_WAIT2       5
+#define TCP_CLOSE           7
+#define TCP_CLOSE_WAIT      8
+#define TCP_LAST_ACK        9
+#define TCP_LISTEN          10
+#define TCP_CLOSING         11
+#define TCP_STATE_MAX       16
+
+// TCP header flags
+#define TCP_FLAG_RST        0x04
+
+// DNS
+#define DNS_PORT            53
+#define DNS_MAX_LEN         512 /* Captured message bytes, the classic UDP limit */
+
+// TLS
+#define TLS_RECORD_HANDSHAKE    0x16
+#define TLS_CLIENT_HELLO        0x01
+#define TLS_MAX_LEN             2048 /* Captured ClientHello bytes */
+
+// HTTP/1.x request methods and status line, as the first four payload bytes
+#define HTTP_WORD(a, b, c, d)   (((__u32)(a) << 24) | ((b) << 16) | ((c) << 8) | (d))
+#define HTTP_MAX_LEN            256 /* Captured bytes of a request or status line */
+
+// Fragment offset masks
+#define IP_OFFSET   0x1FFF
+#define IP6_OFFSET  0xFFF8
+
+// log2 histogram buckets
+#define HIST_SLOTS  32
+
+// Cgroup levels searched for a monitored ancestor, below the root
+#define CGROUP_MAX_DEPTH    16
+
+// TC verdict that hands the packet on to the next program or filter
+#define TC_ACT_UNSPEC -1
+
+// Address families
+#define AF_INET     2
+#define AF_INET6    10
+
+// Account traffic of every process rather than only monitored ones and
+// their descendants. Set by user space before loading.
+volatile const bool account_all = false;
+
+// Roll traffic of all descendants of a monitored process up to it, rather
+// than accounting each process (TGID) on its own. Set by user space.
+volatile const bool track_descendants = true;
+
+// Report connect, accept and close events through conn_events. Set by
+// user space.
+volatile const bool emit_events = false;
+
+// Copy DNS messages exchanged by accounted processes to dns_events. Set by
+// user space.
+volatile const bool capture_dns = false;
+
+// Copy the start of HTTP/1.x requests and responses of accounted processes
+// to http_events. Set by user space.
+volatile const bool capture_http = false;
+
+// Copy the ClientHello of outgoing TLS connections of accounted processes to
+// tls_events, for their server names. Set by user space.
+volatile const bool capture_tls = false;
+
+// Keep packet size and inter-arrival histograms per process. Set by user
+// space.
+volatile const bool track_histograms = false;
+
+// Account the inner flows of VXLAN, Geneve and GRE packets rather than the
+// tunnel itself. Set by user space.
+volatile const bool decapsulate = false;
+
+// Account traffic of processes in monitored cgroups, including their
+// descendant cgroups. Set by user space.
+volatile const bool track_cgroups = false;
+
+// Index of the returned socket in the context of inet_csk_accept: 2 since
+// Linux 6.10, which passes a struct proto_accept_arg instead of flags, err
+// and kern, and 4 before. Set by user space from the kernel's BTF.
+volatile const __u32 accept_ret_arg = 2;
+
+// Number of possible CPUs, for summing per-CPU statistics. Set by user space.
+volatile const __u32 nr_cpus = 1;
+
+// Read-only cast of a socket pointer to its kernel type
+extern void *bpf_rdonly_cast(const void *obj, __u32 btf_id) __ksym;
+
+// Map to store process network statistics. Per-CPU so that packets handled
+// concurrently on different CPUs never race on the same counters; user space
+// sums the per-CPU values.
 struct {
-    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
     __uint(max_entries, 10000);
     __type(key, __u32);    // PID or TGID
     __type(value, struct network_stats);
 } process_stats SEC(".maps");
 
+// Map of processes whose final statistics were handed to user space on
+// exit, so that their closing sockets do not recreate process_stats entries.
+// Entries go when the PID is reused.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 16384);
+    __type(key, __u32);    // TGID
+    __type(value, __u8);
+} exited_pids SEC(".maps");
+
 // Map to store interface filtering
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, 256);
     __type(key, __u32);    // Interface index
-    __type(value, __u8);   // Enabled flag
+    __type(value, __u8);   // IFACE_* flags
 } interface_filter SEC(".maps");
 
-// Map to track process hierarchy
+// Map of processes whose traffic is accounted. Monitored processes map to
+// themselves; with track_descendants, their descendants are added on fork
+// and map to the monitored process they are rolled up to.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 32768);
+    __type(key, __u32);    // TGID
+    __type(value, __u32);  // TGID traffic is accounted to
+} monitored_pids SEC(".maps");
+
+// Map of cgroups whose traffic is accounted, together with their descendant
+// cgroups. Processes monitored by PID take precedence. Keys for cgroups are
+// chosen by user space above the PID range.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 1024);
+    __type(key, __u64);    // Cgroup ID
+    __type(value, __u32);  // Key traffic is accounted to
+} monitored_cgroups SEC(".maps");
+
+// Map to track the owning process of each socket
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 65536);
+    __type(key, __u64);    // Socket cookie
+    __type(value, struct sock_owner);
+} sock_owners SEC(".maps");
+
+// Map to track per-connection statistics
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct conn_key);
+    __type(value, struct conn_stats);
+} connections SEC(".maps");
+
+// Map to count dropped packets per process and drop reason
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct drop_key);
+    __type(value, __u64);  // Packets
+} drops SEC(".maps");
+
+// Map to store packet size and inter-arrival histograms per process. Shared
+// between CPUs, since gaps are measured from the previous packet on any CPU.
 struct {
     __uint(type, BPF_MAP_TYPE_HASH);
     __uint(max_entries, 10000);
-    __type(key, __u32);    // Child PID
-    __type(value, __u32);  // Parent PID
-} process_hierarchy SEC(".maps");
+    __type(key, __u32);    // PID or TGID
+    __type(value, struct histograms);
+} histograms SEC(".maps");
+
+// Map to store per-interface statistics of each process, per CPU
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+    __uint(max_entries, 16384);
+    __type(key, struct iface_key);
+    __type(value, struct traffic_stats);
+} iface_stats SEC(".maps");
+
+// Ring buffer carrying the final statistics of exited processes
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} exits SEC(".maps");
+
+// Ring buffer carrying connection lifecycle events
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} conn_events SEC(".maps");
+
+// Ring buffer carrying DNS messages to and from port 53
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} dns_events SEC(".maps");
+
+// Ring buffer carrying TLS ClientHello messages of outgoing connections
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} tls_events SEC(".maps");
+
+// Ring buffer carrying the start of plaintext HTTP/1.x messages
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} http_events SEC(".maps");
+
+// Byte and packet counters for a subset of a process's traffic
+struct traffic_stats {
+    __u64 bytes_in;
+    __u64 bytes_out;
+    __u64 packets_in;
+    __u64 packets_out;
+};
 
 // Network statistics structure matching user space
 struct network_stats {
@@ -38,71 +263,1395 @@ struct network_stats {
     __u64 bytes_out;
     __u64 packets_in;
     __u64 packets_out;
-    __u32 tcp_connections;
+    struct traffic_stats ipv4;
+    struct traffic_stats ipv6;
+    struct traffic_stats socket;        // Payload at the socket layer; packets are calls
+    __u64 retransmits;                  // Retransmitted TCP segments
+    __u64 rst_in;                       // TCP resets received
+    __u64 rst_out;                      // TCP resets sent
+    __u64 srtt_sum_us;                  // Smoothed RTT summed over TCP packets
+    __u64 rttvar_sum_us;                // RTT variance summed over TCP packets
+    __u64 rtt_samples;                  // TCP packets with an RTT sample
+    __u32 tcp_connections;              // Currently open TCP connections
     __u32 udp_connections;
+    __u32 tcp_states[TCP_STATE_MAX];    // TCP sockets per state
+};
+
+// log2 histograms of a process's traffic, index 0 for ingress and 1 for
+// egress. Bucket i counts values in [2^i, 2^(i+1)); bucket 0 also counts 0.
+struct histograms {
+    __u64 last_seen[2];             // Time of the last packet, CLOCK_MONOTONIC ns
+    __u64 size[2][HIST_SLOTS];      // Packet sizes in bytes
+    __u64 gap[2][HIST_SLOTS];       // Gaps between packets in microseconds
+};
+
+// Initial histograms, too large to be built on the BPF stack
+static const struct histograms empty_histograms;
+
+// Per-interface statistics identifier
+struct iface_key {
+    __u32 pid;
+    __u32 ifindex;
+};
+
+// Dropped packet counter identifier
+struct drop_key {
+    __u32 pid;
+    __u32 reason;       // enum skb_drop_reason
+};
+
+// Connection identifier: owning process plus 5-tuple from the local side.
+// Addresses are in network byte order, ports in host byte order.
+struct conn_key {
+    __u32 pid;
+    __u16 family;
+    __u8 protocol;
+    __u8 pad;
+    __u8 laddr[16];
+    __u8 raddr[16];
+    __u16 lport;
+    __u16 rport;
+};
+
+// Per-connection counters; timestamps are CLOCK_MONOTONIC nanoseconds
+struct conn_stats {
+    __u64 bytes_in;
+    __u64 bytes_out;
+    __u64 packets_in;
+    __u64 packets_out;
+    __u64 sock_bytes_in;    // Payload at the socket layer
+    __u64 sock_bytes_out;
+    __u64 first_seen;
+    __u64 last_seen;
+    __u32 srtt_us;      // Latest smoothed RTT
+    __u32 rttvar_us;    // Latest RTT variance
+    __u32 retransmits;  // Retransmitted segments
+    __u32 rsts;         // Resets sent or received
+    __u8 tcp_flags;     // Union of all TCP flags seen
+    __u8 state;         // Current TCP state, 0 if unknown
+    __u8 payload_seen;  // Set once the first outgoing payload was inspected
+};
+
+// Final statistics of an exited process, summed over all CPUs
+struct exit_event {
+    __u32 pid;
+    __u32 pad;
+    struct network_stats stats;
+};
+
+// Connection lifecycle event types
+#define CONN_EVENT_CONNECT  1
+#define CONN_EVENT_ACCEPT   2
+#define CONN_EVENT_CLOSE    3
+
+// Connection lifecycle event. Addresses are in network byte order, ports in
+// host byte order; counters and duration are only set on close.
+struct conn_event {
+    __u64 timestamp;    // CLOCK_MONOTONIC nanoseconds
+    __u64 duration;     // Nanoseconds since the connection was first seen
+    __u64 bytes_in;
+    __u64 bytes_out;
+    __u64 packets_in;
+    __u64 packets_out;
+    __u32 pid;
+    __u8 type;
+    __u8 protocol;
+    __u16 family;
+    __u8 laddr[16];
+    __u8 raddr[16];
+    __u16 lport;
+    __u16 rport;
+    char comm[16];      // Empty if not raised in the owner's context
+};
+
+// DNS message seen on the wire, parsed in user space. Addresses are in
+// network byte order, ports in host byte order; the remote end is the
+// server. Messages over TCP start with their two byte length prefix.
+struct dns_event {
+    __u64 timestamp;    // CLOCK_MONOTONIC nanoseconds
+    __u32 pid;          // Process the message is accounted to
+    __u16 len;          // Bytes captured in data
+    __u8 ingress;       // Set for responses, clear for queries
+    __u8 protocol;
+    __u16 family;
+    __u16 lport;
+    __u16 rport;
+    __u8 pad[2];
+    __u8 laddr[16];
+    __u8 raddr[16];
+    __u8 data[DNS_MAX_LEN];
+};
+
+// Start of a TLS ClientHello sent on a connection, parsed in user space
+struct tls_event {
+    struct conn_key key;
+    __u16 len;          // Bytes captured in data
+    __u8 pad[2];
+    __u8 data[TLS_MAX_LEN];
+};
+
+// Start of an HTTP/1.x request or response, parsed in user space
+struct http_event {
+    struct conn_key key;
+    __u16 len;          // Bytes captured in data
+    __u8 ingress;
+    __u8 pad;
+    __u64 conn_bytes;   // Bytes on the connection before this message
+    __u8 data[HTTP_MAX_LEN];
 };
 
-// Track process creation
-SEC("tp/sched/sched_process_fork")
-int trace_fork(struct trace_event_raw_sched_process_fork *ctx)
+// Ring buffer records are only referenced through pointers, which clang
+// leaves out of BTF; these keep them in for bpf2go
+const struct exit_event *unused_exit_event __attribute__((unused));
+const struct conn_event *unused_conn_event __attribute__((unused));
+const struct dns_event *unused_dns_event __attribute__((unused));
+const struct tls_event *unused_tls_event __attribute__((unused));
+const struct http_event *unused_http_event __attribute__((unused));
+
+// Process that created, connected or accepted a socket
+struct sock_owner {
+    __u32 tgid;
+    __u8 state;         // TCP state counted in the owner's tcp_states
+    __u8 pad[3];
+    __u64 cgroup_id;    // Monitored cgroup the owner ran in, 0 if none
+};
+
+// Track process creation: a new process whose parent is monitored is
+// accounted to the same monitored process, at any depth
+SEC("tp_btf/sched_process_fork")
+int BPF_PROG(trace_fork, struct task_struct *parent, struct task_struct *child)
 {
-    __u32 parent_pid = bpf_get_current_pid_tgid() >> 32;
-    __u32 child_pid = ctx->child_pid;
+    // New threads are accounted with their process
+    __u32 tgid = child->tgid;
+    if (child->pid != tgid)
+        return 0;
+
+    // The PID may be reused from an exited process
+    bpf_map_delete_elem(&exited_pids, &tgid);
 
-    // Store parent-child relationship
-    bpf_map_update_elem(&process_hierarchy, &child_pid, &parent_pid, BPF_ANY);
+    if (!track_descendants)
+        return 0;
+
+    __u32 parent_tgid = child->real_parent->tgid;
+    __u32 *root = bpf_map_lookup_elem(&monitored_pids, &parent_tgid);
+    if (root)
+        bpf_map_update_elem(&monitored_pids, &tgid, root, BPF_ANY);
     return 0;
 }
 
+// Add a set of traffic counters to another
+static __always_inline void add_traffic(struct traffic_stats *dst, struct traffic_stats *src)
+{
+    dst->bytes_in += src->bytes_in;
+    dst->bytes_out += src->bytes_out;
+    dst->packets_in += src->packets_in;
+    dst->packets_out += src->packets_out;
+}
+
+// Add a packet to a set of traffic counters
+static __always_inline void account_traffic(struct traffic_stats *t, __u32 len, bool ingress)
+{
+    if (ingress) {
+        t->packets_in++;
+        t->bytes_in += len;
+    } else {
+        t->packets_out++;
+        t->bytes_out += len;
+    }
+}
+
+// bpf_loop callback adding one CPU's statistics of an exited process
+static long sum_cpu_stats(__u32 cpu, void *data)
+{
+    struct exit_event *event = data;
+    struct network_stats *s = bpf_map_lookup_percpu_elem(&process_stats, &event->pid, cpu);
+    if (!s)
+        return 0;
+
+    event->stats.bytes_in += s->bytes_in;
+    event->stats.bytes_out += s->bytes_out;
+    event->stats.packets_in += s->packets_in;
+    event->stats.packets_out += s->packets_out;
+    add_traffic(&event->stats.ipv4, &s->ipv4);
+    add_traffic(&event->stats.ipv6, &s->ipv6);
+    add_traffic(&event->stats.socket, &s->socket);
+    event->stats.retransmits += s->retransmits;
+    event->stats.rst_in += s->rst_in;
+    event->stats.rst_out += s->rst_out;
+    event->stats.srtt_sum_us += s->srtt_sum_us;
+    event->stats.rttvar_sum_us += s->rttvar_sum_us;
+    event->stats.rtt_samples += s->rtt_samples;
+    event->stats.tcp_connections += s->tcp_connections;
+    event->stats.udp_connections += s->udp_connections;
+    for (int i = 0; i < TCP_STATE_MAX; i++)
+        event->stats.tcp_states[i] += s->tcp_states[i];
+    return 0;
+}
+
+// Track process exit: once the whole process is gone, forget it and hand
+// its final statistics to user space
+SEC("tp_btf/sched_process_exit")
+int BPF_PROG(trace_exit, struct task_struct *task)
+{
+    __u32 tgid = task->tgid;
+
+    // Other threads of the process are still running
+    if (task->signal->live.counter)
+        return 0;
+
+    // A reused PID must not inherit monitoring
+    bpf_map_delete_elem(&monitored_pids, &tgid);
+
+    if (!bpf_map_lookup_elem(&process_stats, &tgid))
+        return 0;
+
+    // Its sockets may still change state and send packets while they close;
+    // those must not recreate the entry once it is handed over
+    __u8 exited = 1;
+    bpf_map_update_elem(&exited_pids, &tgid, &exited, BPF_ANY);
+
+    struct exit_event event = {
+        .pid = tgid,
+    };
+    bpf_loop(nr_cpus, sum_cpu_stats, &event, 0);
+    bpf_ringbuf_output(&exits, &event, sizeof(event), 0);
+
+    bpf_map_delete_elem(&process_stats, &tgid);
+    return 0;
+}
+
+// Check whether pid is itself a monitored process, as opposed to a
+// descendant rolled up to one
+static __always_inline bool is_monitored(__u32 pid)
+{
+    __u32 *root = bpf_map_lookup_elem(&monitored_pids, &pid);
+    return root && *root == pid;
+}
+
+// Find the process traffic of pid is accounted to: pid itself or the
+// monitored process it is rolled up to. Other processes are accounted to
+// themselves in account_all mode and not at all (0) otherwise.
 static __always_inline __u32 get_root_pid(__u32 pid)
 {
-    // Traverse up the process hierarchy to find the root monitored process
-    for (int i = 0; i < 5; i++) { // Limit traversal depth
-        __u32 *parent = bpf_map_lookup_elem(&process_hierarchy, &pid);
-        if (!parent)
+    __u32 *root = bpf_map_lookup_elem(&monitored_pids, &pid);
+    if (root) {
+        __u32 root_pid = *root;
+        // Descendants stop counting once their monitored process is gone
+        if (root_pid == pid || is_monitored(root_pid))
+            return root_pid;
+    }
+
+    return account_all ? pid : 0;
+}
+
+// Find the monitored cgroup the current task runs in, at any depth, or 0.
+// The innermost monitored cgroup wins.
+static __always_inline __u64 current_monitored_cgroup(void)
+{
+    if (!track_cgroups)
+        return 0;
+
+    __u64 found = 0;
+    for (int level = 1; level <= CGROUP_MAX_DEPTH; level++) {
+        __u64 id = bpf_get_current_ancestor_cgroup_id(level);
+        if (!id)
             break;
-        pid = *parent;
+        if (bpf_map_lookup_elem(&monitored_cgroups, &id))
+            found = id;
     }
-    return pid;
+    return found;
 }
 
-static __always_inline int handle_skb(struct __sk_buff *skb, bool ingress)
+// Find the monitored cgroup the socket of an egress packet was created in,
+// for sockets without a recorded owner, and return its key or 0
+static __always_inline __u32 skb_cgroup_root(struct __sk_buff *skb)
 {
-    // Check interface filter if enabled
-    __u32 ifindex = skb->ifindex;
-    __u8 *enabled = bpf_map_lookup_elem(&interface_filter, &ifindex);
-    if (enabled && !*enabled) {
-        return 1; // Interface filtered out
+    if (!track_cgroups)
+        return 0;
+
+    __u32 root = 0;
+    for (int level = 1; level <= CGROUP_MAX_DEPTH; level++) {
+        __u64 id = bpf_skb_ancestor_cgroup_id(skb, level);
+        if (!id)
+            break;
+        __u32 *key = bpf_map_lookup_elem(&monitored_cgroups, &id);
+        if (key)
+            root = *key;
+    }
+    return root;
+}
+
+// Find the key traffic of a socket's owner is accounted to: the monitored
+// process it is rolled up to, else the monitored cgroup it ran in, else
+// as for any other process
+static __always_inline __u32 get_owner_root(struct sock_owner *owner)
+{
+    if (owner->cgroup_id && !bpf_map_lookup_elem(&monitored_pids, &owner->tgid)) {
+        __u32 *root = bpf_map_lookup_elem(&monitored_cgroups, &owner->cgroup_id);
+        if (root)
+            return *root;
     }
+    return get_root_pid(owner->tgid);
+}
 
-    // Get process ID
-    __u64 pid_tgid = bpf_get_current_pid_tgid();
-    __u32 pid = pid_tgid >> 32;
-    if (!pid) {
-        // Try to get socket info if available
-        struct bpf_sock *sk = skb->sk;
-        if (!sk) {
-            return 1; // No socket associated
+// Get the statistics entry of a process, creating it if needed
+static __always_inline struct network_stats *get_process_stats(__u32 pid)
+{
+    struct network_stats *stats = bpf_map_lookup_elem(&process_stats, &pid);
+    if (stats)
+        return stats;
+
+    // Exited processes were already handed to user space
+    if (bpf_map_lookup_elem(&exited_pids, &pid))
+        return NULL;
+
+    struct network_stats new_stats = {};
+    bpf_map_update_elem(&process_stats, &pid, &new_stats, BPF_NOEXIST);
+    return bpf_map_lookup_elem(&process_stats, &pid);
+}
+
+// States in which a TCP socket counts as an open connection
+static __always_inline bool tcp_state_open(__u8 state)
+{
+    switch (state) {
+    case TCP_ESTABLISHED:
+    case TCP_SYN_SENT:
+    case TCP_SYN_RECV:
+    case TCP_FIN_WAIT1:
+    case TCP_FIN_WAIT2:
+    case TCP_CLOSE_WAIT:
+    case TCP_LAST_ACK:
+    case TCP_CLOSING:
+        return true;
+    default:
+        return false;
+    }
+}
+
+// Add delta to the count of sockets in a TCP state, unless the state is 0.
+// The barrier keeps the compiler from folding both checks into one on a
+// different register than the index, which the verifier cannot follow.
+static __always_inline void count_tcp_state(struct network_stats *stats, __u8 state, __u32 delta)
+{
+    __u64 i = state;
+    if (!i)
+        return;
+    barrier_var(i);
+    if (i < TCP_STATE_MAX)
+        stats->tcp_states[i] += delta;
+}
+
+// Move one socket between TCP states in the per-process counters of the
+// key it is accounted to. State 0 means the socket is not counted. A socket
+// may leave a state on another CPU than it entered it, so the per-CPU gauges
+// are allowed to wrap below zero; their sum in user space is exact.
+static __always_inline void account_tcp_state(__u32 root_pid, __u8 oldstate, __u8 newstate)
+{
+    if (!root_pid)
+        return;
+
+    struct network_stats *stats = get_process_stats(root_pid);
+    if (!stats)
+        return;
+
+    count_tcp_state(stats, oldstate, -1);
+    count_tcp_state(stats, newstate, 1);
+
+    if (tcp_state_open(oldstate))
+        stats->tcp_connections--;
+    if (tcp_state_open(newstate))
+        stats->tcp_connections++;
+}
+
+// Build the connection key of a socket, as seen from the local side.
+// IPv4-mapped IPv6 sockets are keyed as IPv4 to match what TC sees.
+static __always_inline void sk_conn_key(struct sock *sk, __u32 pid, struct conn_key *key)
+{
+    __u16 family = sk->__sk_common.skc_family;
+
+    key->pid = pid;
+    key->protocol = sk->sk_protocol;
+    key->lport = sk->__sk_common.skc_num;
+    key->rport = bpf_ntohs(sk->__sk_common.skc_dport);
+
+    if (family == AF_INET) {
+        key->family = AF_INET;
+        bpf_probe_read_kernel(key->laddr, 4, &sk->__sk_common.skc_rcv_saddr);
+        bpf_probe_read_kernel(key->raddr, 4, &sk->__sk_common.skc_daddr);
+        return;
+    }
+
+    struct in6_addr daddr = sk->__sk_common.skc_v6_daddr;
+    if (!daddr.in6_u.u6_addr32[0] && !daddr.in6_u.u6_addr32[1] &&
+        daddr.in6_u.u6_addr32[2] == bpf_htonl(0xffff)) {
+        key->family = AF_INET;
+        bpf_probe_read_kernel(key->laddr, 4, &sk->__sk_common.skc_v6_rcv_saddr.in6_u.u6_addr32[3]);
+        bpf_probe_read_kernel(key->raddr, 4, &daddr.in6_u.u6_addr32[3]);
+        return;
+    }
+
+    key->family = AF_INET6;
+    bpf_probe_read_kernel(key->laddr, 16, &sk->__sk_common.skc_v6_rcv_saddr);
+    bpf_probe_read_kernel(key->raddr, 16, &daddr);
+}
+
+// Get the entry of a connection, creating it if needed. If created is set,
+// it tells whether this call created the entry.
+static __always_inline struct conn_stats *get_conn(struct conn_key *key, __u64 now,
+                                                   bool *created)
+{
+    struct conn_stats *conn = bpf_map_lookup_elem(&connections, key);
+    if (conn)
+        return conn;
+
+    struct conn_stats new_conn = {
+        .first_seen = now,
+    };
+    long err = bpf_map_update_elem(&connections, key, &new_conn, BPF_NOEXIST);
+    if (created)
+        *created = err == 0;
+    return bpf_map_lookup_elem(&connections, key);
+}
+
+// Record the current TCP state of an owned socket, both in the owner's
+// per-state counters and on its connection entry
+static __always_inline void set_tcp_state(struct sock *sk, struct sock_owner *owner, __u8 state)
+{
+    __u8 counted = state == TCP_CLOSE ? 0 : state;
+    if (owner->state != counted) {
+        account_tcp_state(get_owner_root(owner), owner->state, counted);
+        owner->state = counted;
+    }
+
+    // Listening sockets have no peer and are not connections
+    if (state == TCP_LISTEN)
+        return;
+
+    __u32 root_pid = get_owner_root(owner);
+    if (!root_pid)
+        return;
+
+    struct conn_key key = {};
+    sk_conn_key(sk, root_pid, &key);
+
+    __u64 now = bpf_ktime_get_ns();
+    struct conn_stats *conn = get_conn(&key, now, NULL);
+    if (!conn)
+        return;
+    conn->state = state;
+    conn->last_seen = now;
+}
+
+// Report a lifecycle event of an owned TCP socket
+static __always_inline void emit_conn_event(struct sock *sk, struct sock_owner *owner, __u8 type)
+{
+    if (!emit_events)
+        return;
+
+    __u32 tgid = owner->tgid;
+    __u32 root_pid = get_owner_root(owner);
+    if (!root_pid)
+        return;
+
+    struct conn_key key = {};
+    sk_conn_key(sk, root_pid, &key);
+
+    struct conn_event *event = bpf_ringbuf_reserve(&conn_events, sizeof(*event), 0);
+    if (!event)
+        return;
+    __builtin_memset(event, 0, sizeof(*event));
+
+    event->timestamp = bpf_ktime_get_ns();
+    event->pid = tgid;
+    event->type = type;
+    event->protocol = key.protocol;
+    event->family = key.family;
+    __builtin_memcpy(event->laddr, key.laddr, sizeof(key.laddr));
+    __builtin_memcpy(event->raddr, key.raddr, sizeof(key.raddr));
+    event->lport = key.lport;
+    event->rport = key.rport;
+
+    // Close events may be raised from softirq on behalf of any task
+    if ((bpf_get_current_pid_tgid() >> 32) == tgid)
+        bpf_get_current_comm(event->comm, sizeof(event->comm));
+
+    if (type == CONN_EVENT_CLOSE) {
+        struct conn_stats *conn = bpf_map_lookup_elem(&connections, &key);
+        if (conn) {
+            event->duration = event->timestamp - conn->first_seen;
+            event->bytes_in = conn->bytes_in;
+            event->bytes_out = conn->bytes_out;
+            event->packets_in = conn->packets_in;
+            event->packets_out = conn->packets_out;
         }
-        // Use socket cookie as identifier
-        __u64 cookie = bpf_get_socket_cookie(skb);
-        if (!cookie) {
-            return 1;
+    }
+
+    bpf_ringbuf_submit(event, 0);
+}
+
+// Record the current process as the owner of an inet socket and return the
+// owner, or NULL. Must be called from process context (socket syscalls),
+// never from softirq.
+static __always_inline struct sock_owner *set_sock_owner(struct sock *sk)
+{
+    __u16 family = sk->__sk_common.skc_family;
+    if (family != AF_INET && family != AF_INET6)
+        return NULL;
+
+    __u32 tgid = bpf_get_current_pid_tgid() >> 32;
+    if (!tgid)
+        return NULL; // Kernel thread
+
+    __u64 cgroup_id = current_monitored_cgroup();
+    __u64 cookie = bpf_get_socket_cookie(sk);
+    struct sock_owner *owner = bpf_map_lookup_elem(&sock_owners, &cookie);
+    if (owner) {
+        // Hand the counted TCP state over to the new owner
+        __u32 old_root = get_owner_root(owner);
+        owner->tgid = tgid;
+        owner->cgroup_id = cgroup_id;
+        __u32 new_root = get_owner_root(owner);
+        if (old_root != new_root && owner->state) {
+            account_tcp_state(old_root, owner->state, 0);
+            account_tcp_state(new_root, 0, owner->state);
         }
-        pid = (__u32)cookie;
+    } else {
+        struct sock_owner new_owner = {
+            .tgid = tgid,
+            .cgroup_id = cgroup_id,
+        };
+        bpf_map_update_elem(&sock_owners, &cookie, &new_owner, BPF_ANY);
+        owner = bpf_map_lookup_elem(&sock_owners, &cookie);
+        if (!owner)
+            return NULL;
+    }
+
+    // Sockets accepted from a listener changed state before they had an owner
+    if (sk->sk_protocol == IPPROTO_TCP)
+        set_tcp_state(sk, owner, sk->__sk_common.skc_state);
+    return owner;
+}
+
+// Track socket creation
+SEC("fexit/sock_init_data")
+int BPF_PROG(trace_sock_create, struct socket *sock, struct sock *sk)
+{
+    if (sk)
+        set_sock_owner(sk);
+    return 0;
+}
+
+// Track outgoing TCP connections
+SEC("fentry/tcp_connect")
+int BPF_PROG(trace_tcp_connect, struct sock *sk)
+{
+    struct sock_owner *owner = set_sock_owner(sk);
+    if (owner)
+        emit_conn_event(sk, owner, CONN_EVENT_CONNECT);
+    return 0;
+}
+
+// Track accepted TCP connections. Only the slot of the return value that
+// matches the running kernel is read; the verifier skips the other branch.
+SEC("fexit/inet_csk_accept")
+int trace_accept(unsigned long long *ctx)
+{
+    struct sock *newsk;
+    if (accept_ret_arg == 4) {
+        newsk = (struct sock *)ctx[4];
+        barrier_var(newsk);
+    } else {
+        newsk = (struct sock *)ctx[2];
+        barrier_var(newsk);
     }
+    if (!newsk)
+        return 0;
+
+    struct sock_owner *owner = set_sock_owner(newsk);
+    if (owner)
+        emit_conn_event(newsk, owner, CONN_EVENT_ACCEPT);
+    return 0;
+}
+
+// Track TCP state changes of owned sockets
+SEC("tp_btf/inet_sock_set_state")
+int BPF_PROG(trace_inet_sock_set_state, struct sock *sk, int oldstate, int newstate)
+{
+    if (sk->sk_protocol != IPPROTO_TCP)
+        return 0;
+
+    // Sockets without a cookie were never given an owner
+    __u64 cookie = sk->__sk_common.skc_cookie.counter;
+    if (!cookie)
+        return 0;
+
+    struct sock_owner *owner = bpf_map_lookup_elem(&sock_owners, &cookie);
+    if (!owner)
+        return 0;
 
-    // Get root process ID
-    __u32 root_pid = get_root_pid(pid);
+    set_tcp_state(sk, owner, newstate);
+    if (newstate == TCP_CLOSE && oldstate != TCP_LISTEN)
+        emit_conn_event(sk, owner, CONN_EVENT_CLOSE);
+    return 0;
+}
+
+// Forget sockets as they are destroyed
+SEC("fentry/inet_sock_destruct")
+int BPF_PROG(trace_sock_destruct, struct sock *sk)
+{
+    __u64 cookie = sk->__sk_common.skc_cookie.counter;
+    if (!cookie)
+        return 0;
+
+    struct sock_owner *owner = bpf_map_lookup_elem(&sock_owners, &cookie);
+    if (owner && owner->state)
+        account_tcp_state(get_owner_root(owner), owner->state, 0);
+    bpf_map_delete_elem(&sock_owners, &cookie);
+    return 0;
+}
+
+// Count retransmitted segments of owned TCP sockets
+SEC("tp_btf/tcp_retransmit_skb")
+int BPF_PROG(trace_tcp_retransmit, struct sock *sk, struct sk_buff *skb)
+{
+    __u64 cookie = sk->__sk_common.skc_cookie.counter;
+    if (!cookie)
+        return 0;
+
+    struct sock_owner *owner = bpf_map_lookup_elem(&sock_owners, &cookie);
+    if (!owner)
+        return 0;
+
+    __u32 root_pid = get_owner_root(owner);
+    if (!root_pid)
+        return 0;
+
+    struct network_stats *stats = get_process_stats(root_pid);
+    if (stats)
+        stats->retransmits++;
+
+    struct conn_key key = {};
+    sk_conn_key(sk, root_pid, &key);
+    struct conn_stats *conn = bpf_map_lookup_elem(&connections, &key);
+    if (conn)
+        __sync_fetch_and_add(&conn->retransmits, 1);
+    return 0;
+}
+
+// Count packets of owned sockets dropped by the kernel, by drop reason.
+// Only packets already associated with a socket can be attributed.
+SEC("tp_btf/kfree_skb")
+int BPF_PROG(trace_kfree_skb, struct sk_buff *skb, void *location, enum skb_drop_reason reason)
+{
+    // Freed rather than dropped
+    if (reason <= SKB_CONSUMED)
+        return 0;
+
+    struct sock *sk = skb->sk;
+    if (!sk)
+        return 0;
+
+    __u64 cookie = sk->__sk_common.skc_cookie.counter;
+    if (!cookie)
+        return 0;
+
+    struct sock_owner *owner = bpf_map_lookup_elem(&sock_owners, &cookie);
+    if (!owner)
+        return 0;
+
+    struct drop_key key = {
+        .pid = get_owner_root(owner),
+        .reason = reason,
+    };
+    if (!key.pid)
+        return 0;
+
+    __u64 *count = bpf_map_lookup_elem(&drops, &key);
+    if (count) {
+        __sync_fetch_and_add(count, 1);
+        return 0;
+    }
+
+    __u64 one = 1;
+    bpf_map_update_elem(&drops, &key, &one, BPF_NOEXIST);
+    return 0;
+}
+
+// Account application payload moved through an owned socket, independent
+// of the interface it travels on. Connected sockets also count towards
+// their connection entry.
+static __always_inline void account_socket(struct sock *sk, int bytes, bool ingress)
+{
+    if (bytes <= 0)
+        return;
+
+    __u64 cookie = sk->__sk_common.skc_cookie.counter;
+    if (!cookie)
+        return;
+
+    struct sock_owner *owner = bpf_map_lookup_elem(&sock_owners, &cookie);
+    if (!owner)
+        return;
+
+    __u32 root_pid = get_owner_root(owner);
+    if (!root_pid)
+        return;
+
+    struct network_stats *stats = get_process_stats(root_pid);
+    if (!stats)
+        return;
+    account_traffic(&stats->socket, bytes, ingress);
+
+    // Unconnected UDP sockets have a peer per datagram
+    if (!sk->__sk_common.skc_dport)
+        return;
+
+    struct conn_key key = {};
+    sk_conn_key(sk, root_pid, &key);
+
+    __u64 now = bpf_ktime_get_ns();
+    struct conn_stats *conn = get_conn(&key, now, NULL);
+    if (!conn)
+        return;
+    if (ingress)
+        __sync_fetch_and_add(&conn->sock_bytes_in, bytes);
+    else
+        __sync_fetch_and_add(&conn->sock_bytes_out, bytes);
+    conn->last_seen = now;
+}
+
+// Socket-level accounting. Received TCP data is counted on return from
+// tcp_recvmsg: tcp_cleanup_rbuf is no longer on the recvmsg path since the
+// kernel split out __tcp_cleanup_rbuf.
+SEC("fexit/tcp_sendmsg")
+int BPF_PROG(trace_tcp_sendmsg, struct sock *sk, struct msghdr *msg, size_t size, int ret)
+{
+    account_socket(sk, ret, false);
+    return 0;
+}
+
+SEC("fexit/tcp_recvmsg")
+int BPF_PROG(trace_tcp_recvmsg, struct sock *sk, struct msghdr *msg, size_t len,
+             int flags, int *addr_len, int ret)
+{
+    account_socket(sk, ret, true);
+    return 0;
+}
+
+SEC("fexit/udp_sendmsg")
+int BPF_PROG(trace_udp_sendmsg, struct sock *sk, struct msghdr *msg, size_t len, int ret)
+{
+    account_socket(sk, ret, false);
+    return 0;
+}
+
+SEC("fexit/udp_recvmsg")
+int BPF_PROG(trace_udp_recvmsg, struct sock *sk, struct msghdr *msg, size_t len,
+             int flags, int *addr_len, int ret)
+{
+    account_socket(sk, ret, true);
+    return 0;
+}
+
+SEC("fexit/udpv6_sendmsg")
+int BPF_PROG(trace_udpv6_sendmsg, struct sock *sk, struct msghdr *msg, size_t len, int ret)
+{
+    account_socket(sk, ret, false);
+    return 0;
+}
+
+SEC("fexit/udpv6_recvmsg")
+int BPF_PROG(trace_udpv6_recvmsg, struct sock *sk, struct msghdr *msg, size_t len,
+             int flags, int *addr_len, int ret)
+{
+    account_socket(sk, ret, true);
+    return 0;
+}
+
+// Cookie of a socket returned by bpf_sk_lookup_*. Cookies are generated when
+// the owner is recorded, so a zero cookie means the socket has no owner.
+static __always_inline __u64 get_sk_cookie(struct bpf_sock *sk)
+{
+    struct sock *ksk = bpf_rdonly_cast(sk, bpf_core_type_id_kernel(struct sock));
+    return ksk->__sk_common.skc_cookie.counter;
+}
+
+// Parsed network and transport header fields of a packet
+struct packet_info {
+    struct bpf_sock_tuple tuple;
+    __u16 family;
+    __u8 protocol;
+    __u8 tcp_flags;
+    __u32 srtt_us;      // Smoothed RTT of the TCP socket, 0 if unknown
+    __u32 rttvar_us;
+    __u32 payload_off;  // Offset of the transport payload
+};
+
+// Skip IPv6 extension headers, leaving off and nexthdr at the transport
+// header. Non-initial fragments carry no transport header and are rejected.
+static __always_inline int skip_ipv6_ext(struct __sk_buff *skb, __u32 *off, __u8 *nexthdr)
+{
+    for (int i = 0; i < IPV6_EXT_MAX; i++) {
+        struct ipv6_opt_hdr hdr;
+
+        switch (*nexthdr) {
+        case NEXTHDR_HOP:
+        case NEXTHDR_ROUTING:
+        case NEXTHDR_DEST:
+        case NEXTHDR_AUTH:
+        case NEXTHDR_FRAGMENT:
+            break;
+        default:
+            return 0;
+        }
+
+        if (bpf_skb_load_bytes(skb, *off, &hdr, sizeof(hdr)) < 0)
+            return -1;
+
+        if (*nexthdr == NEXTHDR_FRAGMENT) {
+            struct frag_hdr frag;
+            if (bpf_skb_load_bytes(skb, *off, &frag, sizeof(frag)) < 0)
+                return -1;
+            if (frag.frag_off & bpf_htons(IP6_OFFSET))
+                return -1;
+            *off += sizeof(frag);
+        } else if (*nexthdr == NEXTHDR_AUTH) {
+            *off += (hdr.hdrlen + 2) << 2;
+        } else {
+            *off += (hdr.hdrlen + 1) << 3;
+        }
+        *nexthdr = hdr.nexthdr;
+    }
+
+    return -1;
+}
+
+// Skip the Ethernet header and any VLAN tags at off, leaving off at the
+// network header and proto at its type
+static __always_inline int parse_eth(struct __sk_buff *skb, __u32 *off, __be16 *proto)
+{
+    struct ethhdr eth;
+    if (bpf_skb_load_bytes(skb, *off, &eth, sizeof(eth)) < 0)
+        return -1;
+    *off += sizeof(eth);
+    *proto = eth.h_proto;
+
+    for (int i = 0; i < VLAN_MAX_DEPTH; i++) {
+        if (*proto != bpf_htons(ETH_P_8021Q) && *proto != bpf_htons(ETH_P_8021AD))
+            break;
+
+        struct vlan_hdr vlan;
+        if (bpf_skb_load_bytes(skb, *off, &vlan, sizeof(vlan)) < 0)
+            return -1;
+        *off += sizeof(vlan);
+        *proto = vlan.h_vlan_encapsulated_proto;
+    }
+    return 0;
+}
+
+// Parse the network header of type proto at off into pkt, leaving off at
+// the transport header and protocol at its type. family is filled in as
+// soon as the header is recognised.
+static __always_inline int parse_ip(struct __sk_buff *skb, struct packet_info *pkt,
+                                    __u32 *off, __be16 proto, __u8 *protocol)
+{
+    if (proto == bpf_htons(ETH_P_IP)) {
+        struct iphdr ip;
+        if (bpf_skb_load_bytes(skb, *off, &ip, sizeof(ip)) < 0)
+            return -1;
+        pkt->family = AF_INET;
+        if (ip.frag_off & bpf_htons(IP_OFFSET))
+            return -1; // Non-initial fragment
+        *protocol = ip.protocol;
+        pkt->tuple.ipv4.saddr = ip.saddr;
+        pkt->tuple.ipv4.daddr = ip.daddr;
+        *off += ip.ihl * 4;
+    } else if (proto == bpf_htons(ETH_P_IPV6)) {
+        struct ipv6hdr ip6;
+        if (bpf_skb_load_bytes(skb, *off, &ip6, sizeof(ip6)) < 0)
+            return -1;
+        pkt->family = AF_INET6;
+        *protocol = ip6.nexthdr;
+        __builtin_memcpy(pkt->tuple.ipv6.saddr, &ip6.saddr, sizeof(pkt->tuple.ipv6.saddr));
+        __builtin_memcpy(pkt->tuple.ipv6.daddr, &ip6.daddr, sizeof(pkt->tuple.ipv6.daddr));
+        *off += sizeof(ip6);
+        if (skip_ipv6_ext(skb, off, protocol) < 0)
+            return -1;
+    } else {
+        return -1;
+    }
+    return 0;
+}
+
+// Parse the TCP or UDP header at off into pkt
+static __always_inline int parse_transport(struct __sk_buff *skb, struct packet_info *pkt,
+                                           __u32 off, __u8 protocol)
+{
+    __be16 sport, dport;
+    if (protocol == IPPROTO_TCP) {
+        struct tcphdr tcp;
+        if (bpf_skb_load_bytes(skb, off, &tcp, sizeof(tcp)) < 0)
+            return -1;
+        sport = tcp.source;
+        dport = tcp.dest;
+        pkt->tcp_flags = ((__u8 *)&tcp)[13];
+        pkt->payload_off = off + tcp.doff * 4;
+    } else if (protocol == IPPROTO_UDP) {
+        struct udphdr udp;
+        if (bpf_skb_load_bytes(skb, off, &udp, sizeof(udp)) < 0)
+            return -1;
+        sport = udp.source;
+        dport = udp.dest;
+        pkt->payload_off = off + sizeof(udp);
+    } else {
+        return -1;
+    }
+
+    pkt->protocol = protocol;
+    if (pkt->family == AF_INET) {
+        pkt->tuple.ipv4.sport = sport;
+        pkt->tuple.ipv4.dport = dport;
+    } else {
+        pkt->tuple.ipv6.sport = sport;
+        pkt->tuple.ipv6.dport = dport;
+    }
+    return 0;
+}
+
+// Find the packet carried by a VXLAN, Geneve or GRE packet whose transport
+// header is at off. On success, off is left at the inner packet, which
+// starts with an Ethernet header if eth is set and is of type proto
+// otherwise.
+static __always_inline int parse_tunnel(struct __sk_buff *skb, __u32 *off, __u8 protocol,
+                                        __be16 *proto, bool *eth)
+{
+    if (protocol == IPPROTO_UDP) {
+        struct udphdr udp;
+        if (bpf_skb_load_bytes(skb, *off, &udp, sizeof(udp)) < 0)
+            return -1;
+
+        if (udp.dest == bpf_htons(VXLAN_PORT)) {
+            // 8 byte VXLAN header, then the inner frame
+            *off += sizeof(udp) + 8;
+        } else if (udp.dest == bpf_htons(GENEVE_PORT)) {
+            // 8 byte Geneve header plus options in units of 4 bytes
+            __u8 opt_len;
+            if (bpf_skb_load_bytes(skb, *off + sizeof(udp), &opt_len, 1) < 0)
+                return -1;
+            *off += sizeof(udp) + 8 + (opt_len & 0x3f) * 4;
+        } else {
+            return -1;
+        }
+        *eth = true;
+        return 0;
+    }
+
+    if (protocol == IPPROTO_GRE) {
+        struct {
+            __be16 flags;
+            __be16 proto;
+        } gre;
+        if (bpf_skb_load_bytes(skb, *off, &gre, sizeof(gre)) < 0)
+            return -1;
+
+        __u16 flags = bpf_ntohs(gre.flags);
+        if (flags & GRE_VERSION)
+            return -1; // PPTP
+        *off += sizeof(gre);
+        if (flags & GRE_CSUM)
+            *off += 4;
+        if (flags & GRE_KEY)
+            *off += 4;
+        if (flags & GRE_SEQ)
+            *off += 4;
+
+        *eth = gre.proto == bpf_htons(ETH_P_TEB);
+        *proto = gre.proto;
+        return 0;
+    }
+
+    return -1;
+}
+
+// Parse the packet carried by a tunnel packet into pkt. A global function, so
+// the verifier checks it once rather than on every path of the outer parse;
+// inlined, both parses together exceed its complexity limit. Arguments of
+// global functions are not trusted, hence the NULL check.
+__noinline int parse_inner(struct __sk_buff *skb, struct packet_info *pkt,
+                           __u32 off, __u8 protocol)
+{
+    if (!pkt)
+        return -1;
+
+    __be16 proto = 0;
+    bool eth = false;
+    if (parse_tunnel(skb, &off, protocol, &proto, &eth) < 0)
+        return -1;
+    if (eth && parse_eth(skb, &off, &proto) < 0)
+        return -1;
+
+    __u8 inner_protocol;
+    if (parse_ip(skb, pkt, &off, proto, &inner_protocol) < 0)
+        return -1;
+    return parse_transport(skb, pkt, off, inner_protocol);
+}
+
+// Parse a packet into pkt. Devices without a link-layer header (raw_ip)
+// start with the network header, whose type is then taken from the skb.
+// family is filled in as soon as the network header is recognised; the
+// return value is 0 only if the transport tuple is valid.
+static __always_inline int parse_packet(struct __sk_buff *skb, struct packet_info *pkt,
+                                        bool raw_ip)
+{
+    __u32 off = 0;
+    __be16 proto = skb->protocol;
+    __u8 protocol;
+
+    if (!raw_ip && parse_eth(skb, &off, &proto) < 0)
+        return -1;
+    if (parse_ip(skb, pkt, &off, proto, &protocol) < 0)
+        return -1;
+
+    // Attribute tunnelled flows by their inner tuple, if they can be parsed
+    if (decapsulate) {
+        struct packet_info inner = {};
+        if (parse_inner(skb, &inner, off, protocol) == 0) {
+            *pkt = inner;
+            return 0;
+        }
+    }
+
+    return parse_transport(skb, pkt, off, protocol);
+}
+
+// Read the smoothed RTT and RTT variance of the TCP socket a packet
+// belongs to
+static __always_inline void read_tcp_rtt(struct bpf_sock *sk, struct packet_info *pkt)
+{
+    if (pkt->protocol != IPPROTO_TCP)
+        return;
+
+    struct bpf_sock *full = bpf_sk_fullsock(sk);
+    if (!full)
+        return;
+
+    // Kept scaled by 8 and 4 respectively, see tcp_rtt_estimator()
+    struct tcp_sock *tp = bpf_rdonly_cast(full, bpf_core_type_id_kernel(struct tcp_sock));
+    pkt->srtt_us = tp->srtt_us >> 3;
+    pkt->rttvar_us = tp->mdev_us >> 2;
+}
+
+// Find the owner of the local socket a packet belongs to. Egress packets
+// carry their socket; ingress packets have not been demuxed yet, so the
+// socket is looked up by the packet's 4-tuple.
+static __always_inline struct sock_owner *lookup_owner(struct __sk_buff *skb,
+                                                       struct packet_info *pkt,
+                                                       bool parsed, bool ingress)
+{
+    __u64 cookie = 0;
+
+    if (!ingress) {
+        struct bpf_sock *sk = skb->sk;
+        if (!sk)
+            return NULL;
+        if (parsed)
+            read_tcp_rtt(sk, pkt);
+        cookie = bpf_get_socket_cookie(skb);
+    } else {
+        if (!parsed)
+            return NULL;
+
+        struct bpf_sock *sk;
+        __u32 tuple_size = pkt->family == AF_INET ?
+            sizeof(pkt->tuple.ipv4) : sizeof(pkt->tuple.ipv6);
+        if (pkt->protocol == IPPROTO_TCP)
+            sk = bpf_sk_lookup_tcp(skb, &pkt->tuple, tuple_size, BPF_F_CURRENT_NETNS, 0);
+        else
+            sk = bpf_sk_lookup_udp(skb, &pkt->tuple, tuple_size, BPF_F_CURRENT_NETNS, 0);
+        if (!sk)
+            return NULL;
+
+        read_tcp_rtt(sk, pkt);
+        cookie = get_sk_cookie(sk);
+        bpf_sk_release(sk);
+    }
+
+    if (!cookie)
+        return NULL;
+    return bpf_map_lookup_elem(&sock_owners, &cookie);
+}
+
+// Get the per-interface statistics entry of a process, creating it if needed
+static __always_inline struct traffic_stats *get_iface_stats(struct iface_key *key)
+{
+    struct traffic_stats *t = bpf_map_lookup_elem(&iface_stats, key);
+    if (t)
+        return t;
+
+    struct traffic_stats new_stats = {};
+    bpf_map_update_elem(&iface_stats, key, &new_stats, BPF_NOEXIST);
+    return bpf_map_lookup_elem(&iface_stats, key);
+}
+
+// Fill in the connection identifier of a packet from the local side
+static __always_inline void pkt_conn_key(struct packet_info *pkt, __u32 pid,
+                                         bool ingress, struct conn_key *key)
+{
+    key->pid = pid;
+    key->family = pkt->family;
+    key->protocol = pkt->protocol;
+
+    // The local end is the destination of ingress packets
+    if (pkt->family == AF_INET) {
+        __builtin_memcpy(key->laddr, ingress ? &pkt->tuple.ipv4.daddr : &pkt->tuple.ipv4.saddr, 4);
+        __builtin_memcpy(key->raddr, ingress ? &pkt->tuple.ipv4.saddr : &pkt->tuple.ipv4.daddr, 4);
+        key->lport = bpf_ntohs(ingress ? pkt->tuple.ipv4.dport : pkt->tuple.ipv4.sport);
+        key->rport = bpf_ntohs(ingress ? pkt->tuple.ipv4.sport : pkt->tuple.ipv4.dport);
+    } else {
+        __builtin_memcpy(key->laddr, ingress ? pkt->tuple.ipv6.daddr : pkt->tuple.ipv6.saddr, 16);
+        __builtin_memcpy(key->raddr, ingress ? pkt->tuple.ipv6.saddr : pkt->tuple.ipv6.daddr, 16);
+        key->lport = bpf_ntohs(ingress ? pkt->tuple.ipv6.dport : pkt->tuple.ipv6.sport);
+        key->rport = bpf_ntohs(ingress ? pkt->tuple.ipv6.sport : pkt->tuple.ipv6.dport);
+    }
+}
+
+// Account a packet to its connection, creating the entry on first sight,
+// which is reported through created
+static __always_inline struct conn_stats *update_conn(struct conn_key *key, struct packet_info *pkt,
+                                                      __u32 len, bool ingress, bool *created)
+{
+    __u64 now = bpf_ktime_get_ns();
+    struct conn_stats *conn = get_conn(key, now, created);
+    if (!conn)
+        return NULL;
+
+    // Connections are shared between CPUs, unlike the per-process counters
+    if (ingress) {
+        __sync_fetch_and_add(&conn->packets_in, 1);
+        __sync_fetch_and_add(&conn->bytes_in, len);
+    } else {
+        __sync_fetch_and_add(&conn->packets_out, 1);
+        __sync_fetch_and_add(&conn->bytes_out, len);
+    }
+    if (pkt->tcp_flags & TCP_FLAG_RST)
+        __sync_fetch_and_add(&conn->rsts, 1);
+    if (pkt->srtt_us) {
+        conn->srtt_us = pkt->srtt_us;
+        conn->rttvar_us = pkt->rttvar_us;
+    }
+    conn->tcp_flags |= pkt->tcp_flags;
+    conn->last_seen = now;
+    return conn;
+}
+
+// Number of payload bytes from off on to copy to user space, at most max.
+// The verifier does not know that off lies within the packet, so callers
+// must check for 0. The bound is applied after hiding the value from the
+// compiler, so that it holds on the register passed on as the copy size.
+static __always_inline __u64 capture_len(struct __sk_buff *skb, __u32 off, __u64 max)
+{
+    __u64 len = skb->len - off;
+    barrier_var(len);
+    if (len > max)
+        len = max;
+    return len;
+}
+
+// Copy a DNS query or response of a client socket to user space, which
+// parses it. Only the start of messages split over TCP segments is seen.
+static __always_inline void capture_dns_msg(struct __sk_buff *skb, struct packet_info *pkt,
+                                            struct conn_key *key, bool ingress)
+{
+    if (key->rport != DNS_PORT || pkt->payload_off >= skb->len)
+        return;
+
+    __u64 len = capture_len(skb, pkt->payload_off, DNS_MAX_LEN);
+    if (!len)
+        return;
+
+    struct dns_event *event = bpf_ringbuf_reserve(&dns_events, sizeof(*event), 0);
+    if (!event)
+        return;
+
+    if (bpf_skb_load_bytes(skb, pkt->payload_off, event->data, len) < 0) {
+        bpf_ringbuf_discard(event, 0);
+        return;
+    }
+
+    event->timestamp = bpf_ktime_get_ns();
+    event->pid = key->pid;
+    event->len = len;
+    event->ingress = ingress;
+    event->protocol = key->protocol;
+    event->family = key->family;
+    event->lport = key->lport;
+    event->rport = key->rport;
+    event->pad[0] = event->pad[1] = 0;
+    __builtin_memcpy(event->laddr, key->laddr, sizeof(key->laddr));
+    __builtin_memcpy(event->raddr, key->raddr, sizeof(key->raddr));
+    bpf_ringbuf_submit(event, 0);
+}
+
+// Copy a TLS ClientHello to user space, which extracts the server name.
+// Only the first payload sent on a TCP connection is inspected.
+static __always_inline void capture_client_hello(struct __sk_buff *skb, struct packet_info *pkt,
+                                                 struct conn_key *key, struct conn_stats *conn)
+{
+    if (conn->payload_seen || pkt->payload_off >= skb->len)
+        return;
+    conn->payload_seen = 1;
+
+    // Record header (type, version, length) and handshake type
+    __u8 hdr[6];
+    if (bpf_skb_load_bytes(skb, pkt->payload_off, hdr, sizeof(hdr)) < 0)
+        return;
+    if (hdr[0] != TLS_RECORD_HANDSHAKE || hdr[1] != 0x03 || hdr[5] != TLS_CLIENT_HELLO)
+        return;
+
+    __u64 len = capture_len(skb, pkt->payload_off, TLS_MAX_LEN);
+    if (!len)
+        return;
+
+    struct tls_event *event = bpf_ringbuf_reserve(&tls_events, sizeof(*event), 0);
+    if (!event)
+        return;
+
+    if (bpf_skb_load_bytes(skb, pkt->payload_off, event->data, len) < 0) {
+        bpf_ringbuf_discard(event, 0);
+        return;
+    }
+    event->key = *key;
+    event->len = len;
+    event->pad[0] = event->pad[1] = 0;
+    bpf_ringbuf_submit(event, 0);
+}
+
+// Check whether a TCP payload starts with an HTTP/1.x request line or
+// status line
+static __always_inline bool is_http_start(__u32 word)
+{
+    switch (word) {
+    case HTTP_WORD('G', 'E', 'T', ' '):
+    case HTTP_WORD('P', 'O', 'S', 'T'):
+    case HTTP_WORD('P', 'U', 'T', ' '):
+    case HTTP_WORD('H', 'E', 'A', 'D'):
+    case HTTP_WORD('D', 'E', 'L', 'E'):
+    case HTTP_WORD('P', 'A', 'T', 'C'):
+    case HTTP_WORD('O', 'P', 'T', 'I'):
+    case HTTP_WORD('H', 'T', 'T', 'P'):
+        return true;
+    default:
+        return false;
+    }
+}
+
+// Copy the start of an HTTP/1.x message to user space, together with the
+// connection's byte count so that user space can size each request
+static __always_inline void capture_http_msg(struct __sk_buff *skb, struct packet_info *pkt,
+                                             struct conn_key *key, struct conn_stats *conn,
+                                             bool ingress)
+{
+    if (pkt->payload_off + 4 > skb->len)
+        return;
+
+    __u32 word;
+    if (bpf_skb_load_bytes(skb, pkt->payload_off, &word, sizeof(word)) < 0)
+        return;
+    if (!is_http_start(bpf_ntohl(word)))
+        return;
+
+    __u64 len = capture_len(skb, pkt->payload_off, HTTP_MAX_LEN);
+    if (!len)
+        return;
+
+    struct http_event *event = bpf_ringbuf_reserve(&http_events, sizeof(*event), 0);
+    if (!event)
+        return;
+
+    if (bpf_skb_load_bytes(skb, pkt->payload_off, event->data, len) < 0) {
+        bpf_ringbuf_discard(event, 0);
+        return;
+    }
+    event->key = *key;
+    event->len = len;
+    event->ingress = ingress;
+    event->pad = 0;
+    event->conn_bytes = conn->bytes_in + conn->bytes_out - skb->len;
+    bpf_ringbuf_submit(event, 0);
+}
+
+// Floor of the base 2 logarithm of v, 0 for 0
+static __always_inline __u64 log2l(__u64 v)
+{
+    __u64 r = 0, shift;
+
+    shift = (v > 0xFFFFFFFF) << 5; v >>= shift; r |= shift;
+    shift = (v > 0xFFFF) << 4; v >>= shift; r |= shift;
+    shift = (v > 0xFF) << 3; v >>= shift; r |= shift;
+    shift = (v > 0xF) << 2; v >>= shift; r |= shift;
+    shift = (v > 0x3) << 1; v >>= shift; r |= shift;
+    r |= (v >> 1);
+    return r;
+}
+
+// Histogram bucket of a value
+static __always_inline __u32 hist_slot(__u64 v)
+{
+    // 64 bits wide, so that the verifier keeps the bound
+    __u64 slot = log2l(v);
+    return slot < HIST_SLOTS ? slot : HIST_SLOTS - 1;
+}
+
+// Add a packet to the size and inter-arrival histograms of a process
+static __always_inline void update_histograms(__u32 pid, __u32 len, bool ingress)
+{
+    struct histograms *h = bpf_map_lookup_elem(&histograms, &pid);
+    if (!h) {
+        bpf_map_update_elem(&histograms, &pid, &empty_histograms, BPF_NOEXIST);
+        h = bpf_map_lookup_elem(&histograms, &pid);
+        if (!h)
+            return;
+    }
+
+    __u32 dir = ingress ? 0 : 1;
+    __sync_fetch_and_add(&h->size[dir][hist_slot(len)], 1);
+
+    __u64 now = bpf_ktime_get_ns();
+    __u64 last = __sync_lock_test_and_set(&h->last_seen[dir], now);
+    if (last && now > last)
+        __sync_fetch_and_add(&h->gap[dir][hist_slot((now - last) / 1000)], 1);
+}
+
+static __always_inline int handle_skb(struct __sk_buff *skb, bool ingress)
+{
+    // Check interface filter if enabled
+    __u32 ifindex = skb->ifindex;
+    __u8 *flags = bpf_map_lookup_elem(&interface_filter, &ifindex);
+    if (flags && !(*flags & IFACE_MONITORED)) {
+        return TC_ACT_UNSPEC; // Interface filtered out
+    }
+
+    struct packet_info pkt = {};
+    bool raw_ip = flags && (*flags & IFACE_RAW_IP);
+    bool parsed = parse_packet(skb, &pkt, raw_ip) == 0;
+
+    // Attribute the packet to the process owning its socket. Sockets
+    // created before monitoring started have no recorded owner, but egress
+    // packets still carry the cgroup of theirs.
+    __u32 root_pid = 0;
+    struct sock_owner *owner = lookup_owner(skb, &pkt, parsed, ingress);
+    if (owner)
+        root_pid = get_owner_root(owner);
+    else if (!ingress)
+        root_pid = skb_cgroup_root(skb);
     if (!root_pid) {
-        root_pid = pid; // Use current PID if no parent found
+        return TC_ACT_UNSPEC; // Not a monitored process
     }
 
     // Get or create statistics entry
-    struct network_stats *stats, new_stats = {};
-    stats = bpf_map_lookup_elem(&process_stats, &root_pid);
+    struct network_stats *stats = get_process_stats(root_pid);
     if (!stats) {
-        stats = &new_stats;
+        return TC_ACT_UNSPEC;
     }
 
     // Update packet and byte counts
@@ -114,42 +1663,59 @@ static __always_inline int handle_skb(struct __sk_buff *skb, bool ingress)
         stats->bytes_out += skb->len;
     }
 
-    // Protocol specific counting
-    void *data = (void *)(long)skb->data;
-    void *data_end = (void *)(long)skb->data_end;
-    
-    struct ethhdr *eth = data;
-    if ((void*)(eth + 1) > data_end)
-        goto update;
+    if (pkt.family == AF_INET)
+        account_traffic(&stats->ipv4, skb->len, ingress);
+    else if (pkt.family == AF_INET6)
+        account_traffic(&stats->ipv6, skb->len, ingress);
 
-    if (eth->h_proto != bpf_htons(ETH_P_IP))
-        goto update;
+    if (track_histograms)
+        update_histograms(root_pid, skb->len, ingress);
 
-    struct iphdr *ip = (void*)(eth + 1);
-    if ((void*)(ip + 1) > data_end)
-        goto update;
+    struct iface_key ikey = {
+        .pid = root_pid,
+        .ifindex = ifindex,
+    };
+    struct traffic_stats *iface = get_iface_stats(&ikey);
+    if (iface)
+        account_traffic(iface, skb->len, ingress);
 
-    if (ip->protocol == IPPROTO_TCP) {
-        struct tcphdr *tcp = (void*)(ip + 1);
-        if ((void*)(tcp + 1) <= data_end) {
-            if (tcp->syn && !tcp->ack)
-                stats->tcp_connections++;
+    // TCP health: resets, and RTT weighted by packets
+    if (parsed && pkt.protocol == IPPROTO_TCP) {
+        if (pkt.tcp_flags & TCP_FLAG_RST) {
+            if (ingress)
+                stats->rst_in++;
+            else
+                stats->rst_out++;
         }
-    } else if (ip->protocol == IPPROTO_UDP) {
-        struct udphdr *udp = (void*)(ip + 1);
-        if ((void*)(udp + 1) <= data_end) {
-            stats->udp_connections++;
+        if (pkt.srtt_us) {
+            stats->srtt_sum_us += pkt.srtt_us;
+            stats->rttvar_sum_us += pkt.rttvar_us;
+            stats->rtt_samples++;
         }
     }
 
-update:
-    if (stats == &new_stats) {
-        bpf_map_update_elem(&process_stats, &root_pid, stats, BPF_ANY);
-    } else {
-        bpf_map_update_elem(&process_stats, &root_pid, stats, BPF_EXIST);
+    // Protocol specific counting; open TCP connections are tracked from
+    // socket state changes rather than from packets
+    if (parsed) {
+        struct conn_key key = {};
+        pkt_conn_key(&pkt, root_pid, ingress, &key);
+        bool created = false;
+        struct conn_stats *conn = update_conn(&key, &pkt, skb->len, ingress, &created);
+
+        // UDP flows are counted once, when first seen
+        if (created && pkt.protocol == IPPROTO_UDP)
+            stats->udp_connections++;
+
+        if (conn && capture_tls && !ingress && pkt.protocol == IPPROTO_TCP)
+            capture_client_hello(skb, &pkt, &key, conn);
+        if (conn && capture_http && pkt.protocol == IPPROTO_TCP)
+            capture_http_msg(skb, &pkt, &key, conn, ingress);
+
+        if (capture_dns)
+            capture_dns_msg(skb, &pkt, &key, ingress);
     }
 
-    return 1;
+    return TC_ACT_UNSPEC;
 }
 
 SEC("classifier/ingress")
@@ -164,4 +1730,4 @@ int tc_egress(struct __sk_buff *skb)
     return handle_skb(skb, false);
 }
 
-char LICENSE[] SEC("license") = "GPL";
\ No newline at end of file
+char LICENSE[] SEC("license") = "GPL";
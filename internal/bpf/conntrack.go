@@ -0,0 +1,233 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// Address family and protocol numbers as stored in connection keys
+const (
+	afInet   = unix.AF_INET
+	protoTCP = unix.IPPROTO_TCP
+	protoUDP = unix.IPPROTO_UDP
+)
+
+// TCP header flags as accumulated in connection entries
+const (
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagRst = 0x04
+	tcpFlagAck = 0x10
+)
+
+// tcpStateNames maps kernel TCP state numbers (include/net/tcp_states.h)
+// to their names
+var tcpStateNames = [...]string{
+	1:  "ESTABLISHED",
+	2:  "SYN_SENT",
+	3:  "SYN_RECV",
+	4:  "FIN_WAIT1",
+	5:  "FIN_WAIT2",
+	6:  "TIME_WAIT",
+	7:  "CLOSE",
+	8:  "CLOSE_WAIT",
+	9:  "LAST_ACK",
+	10: "LISTEN",
+	11: "CLOSING",
+	12: "NEW_SYN_RECV",
+	13: "BOUND_INACTIVE",
+}
+
+// tcpStateName returns the name of a kernel TCP state
+func tcpStateName(state uint8) string {
+	if int(state) < len(tcpStateNames) && tcpStateNames[state] != "" {
+		return tcpStateNames[state]
+	}
+	return fmt.Sprintf("STATE_%d", state)
+}
+
+// tcpStateCounts converts the per-state socket counters of a process
+func tcpStateCounts(counts [16]uint32) map[string]uint32 {
+	states := make(map[string]uint32)
+	for state, n := range counts {
+		if n > 0 {
+			states[tcpStateName(uint8(state))] = n
+		}
+	}
+	return states
+}
+
+// getConnections returns the tracked connections owned by each of pids,
+// in a single pass over the kernel map. Connections idle for longer than
+// the configured timeout are removed from the map as a side effect, and
+// ending connections of any process complete their last HTTP request.
+func (nm *NetworkMonitor) getConnections(pids []uint32) (map[uint32]map[string]types.ConnectionInfo, error) {
+	conns := make(map[uint32]map[string]types.ConnectionInfo, len(pids))
+	for _, pid := range pids {
+		conns[pid] = make(map[string]types.ConnectionInfo)
+	}
+	now := monotonicNow()
+	base := time.Now().Add(-now)
+
+	var (
+		key     netmonConnKey
+		val     netmonConnStats
+		expired []netmonConnKey
+	)
+	iter := nm.maps.Connections.Iterate()
+	for iter.Next(&key, &val) {
+		expire := now-time.Duration(val.LastSeen) > nm.connTimeout
+		if nm.http != nil && (expire || val.TcpFlags&(tcpFlagFin|tcpFlagRst) != 0) {
+			nm.http.connectionEnded(key, val.BytesIn+val.BytesOut)
+		}
+		if expire {
+			expired = append(expired, key)
+			continue
+		}
+		owned, ok := conns[key.Pid]
+		if !ok {
+			continue
+		}
+
+		conn := connectionInfo(&key, &val, base)
+		conn.SNI = nm.serverName(&key)
+		owned[conn.LocalAddr+"-"+conn.RemoteAddr] = conn
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate connections: %w", err)
+	}
+
+	for i := range expired {
+		if err := nm.maps.Connections.Delete(&expired[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, fmt.Errorf("failed to expire connection: %w", err)
+		}
+	}
+	nm.forgetServerNames(expired)
+
+	return conns, nil
+}
+
+// clearConnections removes the tracked connections owned by pid
+func (nm *NetworkMonitor) clearConnections(pid uint32) error {
+	var (
+		key   netmonConnKey
+		val   netmonConnStats
+		stale []netmonConnKey
+	)
+	iter := nm.maps.Connections.Iterate()
+	for iter.Next(&key, &val) {
+		if key.Pid == pid {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to iterate connections: %w", err)
+	}
+
+	for i := range stale {
+		if err := nm.maps.Connections.Delete(&stale[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to clear connection: %w", err)
+		}
+	}
+	nm.forgetServerNames(stale)
+	return nil
+}
+
+// serverNameTraffic adds up the traffic of connections per TLS server name
+func serverNameTraffic(conns map[string]types.ConnectionInfo) map[string]types.TrafficStats {
+	traffic := make(map[string]types.TrafficStats)
+	for _, conn := range conns {
+		if conn.SNI == "" {
+			continue
+		}
+		t := traffic[conn.SNI]
+		t.Add(types.TrafficStats{
+			BytesIn:    conn.BytesIn,
+			BytesOut:   conn.BytesOut,
+			PacketsIn:  conn.PacketsIn,
+			PacketsOut: conn.PacketsOut,
+		})
+		traffic[conn.SNI] = t
+	}
+	return traffic
+}
+
+// connectionInfo converts a kernel connection entry to its user space form.
+// base is the wall clock time corresponding to monotonic time zero.
+func connectionInfo(key *netmonConnKey, val *netmonConnStats, base time.Time) types.ConnectionInfo {
+	conn := types.ConnectionInfo{
+		LocalAddr:   formatAddr(key.Family, key.Laddr, key.Lport),
+		RemoteAddr:  formatAddr(key.Family, key.Raddr, key.Rport),
+		BytesIn:     val.BytesIn,
+		BytesOut:    val.BytesOut,
+		PacketsIn:   val.PacketsIn,
+		PacketsOut:  val.PacketsOut,
+		SocketIn:    val.SockBytesIn,
+		SocketOut:   val.SockBytesOut,
+		Retransmits: val.Retransmits,
+		RSTs:        val.Rsts,
+		SRTT:        time.Duration(val.SrttUs) * time.Microsecond,
+		RTTVar:      time.Duration(val.RttvarUs) * time.Microsecond,
+		FirstSeen:   base.Add(time.Duration(val.FirstSeen)),
+		LastUpdated: base.Add(time.Duration(val.LastSeen)),
+	}
+
+	switch key.Protocol {
+	case protoTCP:
+		conn.Protocol = "tcp"
+		if val.State != 0 {
+			conn.State = tcpStateName(val.State)
+		} else {
+			conn.State = tcpStateFromFlags(val.TcpFlags)
+		}
+	case protoUDP:
+		conn.Protocol = "udp"
+	}
+
+	return conn
+}
+
+// tcpStateFromFlags approximates the TCP state from the flags seen on a flow
+// whose socket state changes were not observed
+func tcpStateFromFlags(flags uint8) string {
+	switch {
+	case flags&tcpFlagRst != 0:
+		return "CLOSE"
+	case flags&tcpFlagFin != 0:
+		return "CLOSING"
+	case flags&tcpFlagAck != 0:
+		return "ESTABLISHED"
+	case flags&tcpFlagSyn != 0:
+		return "SYN_SENT"
+	default:
+		return ""
+	}
+}
+
+// formatAddr renders an address from a connection key as "ip:port"
+func formatAddr(family uint16, addr [16]uint8, port uint16) string {
+	var ip net.IP
+	if family == afInet {
+		ip = net.IP(addr[:4])
+	} else {
+		ip = net.IP(addr[:])
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// monotonicNow returns the current CLOCK_MONOTONIC time, the clock used by
+// bpf_ktime_get_ns
+func monotonicNow() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return time.Duration(ts.Nano())
+}
@@ -0,0 +1,74 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionInfo(t *testing.T) {
+	key := netmonConnKey{
+		Pid:      1234,
+		Family:   afInet,
+		Protocol: protoTCP,
+		Laddr:    [16]uint8{10, 0, 0, 1},
+		Raddr:    [16]uint8{1, 2, 3, 4},
+		Lport:    51234,
+		Rport:    443,
+	}
+	val := netmonConnStats{
+		BytesIn:   4096,
+		BytesOut:  512,
+		FirstSeen: uint64(10 * time.Second),
+		LastSeen:  uint64(12 * time.Second),
+		SrttUs:    1500,
+		RttvarUs:  250,
+		TcpFlags:  tcpFlagSyn | tcpFlagAck,
+	}
+
+	conn := connectionInfo(&key, &val, time.Now())
+
+	if conn.LocalAddr != "10.0.0.1:51234" {
+		t.Errorf("Expected local addr 10.0.0.1:51234, got %s", conn.LocalAddr)
+	}
+	if conn.RemoteAddr != "1.2.3.4:443" {
+		t.Errorf("Expected remote addr 1.2.3.4:443, got %s", conn.RemoteAddr)
+	}
+	if conn.Protocol != "tcp" {
+		t.Errorf("Expected protocol tcp, got %s", conn.Protocol)
+	}
+	if conn.State != "ESTABLISHED" {
+		t.Errorf("Expected state ESTABLISHED, got %s", conn.State)
+	}
+	if d := conn.LastUpdated.Sub(conn.FirstSeen); d != 2*time.Second {
+		t.Errorf("Expected 2s between first and last seen, got %v", d)
+	}
+	if conn.SRTT != 1500*time.Microsecond || conn.RTTVar != 250*time.Microsecond {
+		t.Errorf("Expected RTT 1.5ms ±250µs, got %v ±%v", conn.SRTT, conn.RTTVar)
+	}
+}
+
+func TestFormatAddrIPv6(t *testing.T) {
+	addr := [16]uint8{0: 0x20, 1: 0x01, 2: 0x0d, 3: 0xb8, 15: 0x01}
+	if got := formatAddr(10, addr, 53); got != "[2001:db8::1]:53" {
+		t.Errorf("Expected [2001:db8::1]:53, got %s", got)
+	}
+}
+
+func TestTCPStateCounts(t *testing.T) {
+	var counts [16]uint32
+	counts[1] = 3  // ESTABLISHED
+	counts[6] = 2  // TIME_WAIT
+	counts[10] = 1 // LISTEN
+
+	states := tcpStateCounts(counts)
+
+	expected := map[string]uint32{"ESTABLISHED": 3, "TIME_WAIT": 2, "LISTEN": 1}
+	if len(states) != len(expected) {
+		t.Fatalf("Expected %d states, got %v", len(expected), states)
+	}
+	for state, n := range expected {
+		if states[state] != n {
+			t.Errorf("Expected %s=%d, got %d", state, n, states[state])
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+const (
+	// dnsLogLen is the number of DNS queries kept per process
+	dnsLogLen = 64
+	// dnsTimeout is how long a query may go unanswered before it is logged
+	// as timed out
+	dnsTimeout = 5 * time.Second
+	// dnsHeaderLen is the size of the fixed DNS message header
+	dnsHeaderLen = 12
+	// dnsMaxPointers bounds the compression pointers followed in a name
+	dnsMaxPointers = 16
+)
+
+var errDNSTruncated = errors.New("truncated DNS message")
+
+// dnsTypes names common DNS query types
+var dnsTypes = map[uint16]string{
+	1:   "A",
+	2:   "NS",
+	5:   "CNAME",
+	6:   "SOA",
+	12:  "PTR",
+	15:  "MX",
+	16:  "TXT",
+	28:  "AAAA",
+	33:  "SRV",
+	64:  "SVCB",
+	65:  "HTTPS",
+	255: "ANY",
+}
+
+// dnsRCodes names the DNS response codes of the message header
+var dnsRCodes = map[uint8]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// dnsMessage holds the header fields and first question of a DNS message
+type dnsMessage struct {
+	id       uint16
+	response bool
+	rcode    uint8
+	name     string
+	qtype    uint16
+}
+
+// parseDNS parses the header and first question of a DNS message. Messages
+// captured from TCP start with a two byte length prefix.
+func parseDNS(data []byte, tcp bool) (dnsMessage, error) {
+	var msg dnsMessage
+
+	if tcp {
+		if len(data) < 2 {
+			return msg, errDNSTruncated
+		}
+		data = data[2:]
+	}
+	if len(data) < dnsHeaderLen {
+		return msg, errDNSTruncated
+	}
+
+	flags := binary.BigEndian.Uint16(data[2:])
+	msg.id = binary.BigEndian.Uint16(data[0:])
+	msg.response = flags&0x8000 != 0
+	msg.rcode = uint8(flags & 0xf)
+	if binary.BigEndian.Uint16(data[4:]) == 0 {
+		return msg, errors.New("DNS message without question")
+	}
+
+	name, off, err := parseDNSName(data, dnsHeaderLen)
+	if err != nil {
+		return msg, err
+	}
+	if off+4 > len(data) {
+		return msg, errDNSTruncated
+	}
+	msg.name = name
+	msg.qtype = binary.BigEndian.Uint16(data[off:])
+	return msg, nil
+}
+
+// parseDNSName decodes the domain name at off in msg, following
+// compression pointers, and returns it with the offset just past it
+func parseDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSTruncated
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			if len(labels) == 0 {
+				return ".", end, nil
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errDNSTruncated
+			}
+			if pointers++; pointers > dnsMaxPointers {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, fmt.Errorf("unsupported DNS label type %#x", n&0xc0)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errDNSTruncated
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// dnsTypeName returns the name of a DNS query type, e.g. "AAAA"
+func dnsTypeName(qtype uint16) string {
+	if name, ok := dnsTypes[qtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
+// dnsRCodeName returns the name of a DNS response code, e.g. "NXDOMAIN"
+func dnsRCodeName(rcode uint8) string {
+	if name, ok := dnsRCodes[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// dnsKey matches a DNS response to its query
+type dnsKey struct {
+	pid    uint32
+	id     uint16
+	local  string
+	server string
+}
+
+// pendingDNS is a query waiting for its response
+type pendingDNS struct {
+	query types.DNSQuery
+	sent  time.Duration // CLOCK_MONOTONIC
+}
+
+// dnsLog matches DNS queries of monitored processes to their responses and
+// keeps the most recent ones per process
+type dnsLog struct {
+	mu      sync.Mutex
+	pending map[dnsKey]pendingDNS
+	queries map[uint32][]types.DNSQuery
+}
+
+func newDNSLog() *dnsLog {
+	return &dnsLog{
+		pending: make(map[dnsKey]pendingDNS),
+		queries: make(map[uint32][]types.DNSQuery),
+	}
+}
+
+// record handles a DNS message captured by the kernel. base is the wall
+// clock time corresponding to monotonic time zero.
+func (l *dnsLog) record(event *netmonDnsEvent, base time.Time) {
+	data := event.Data[:min(int(event.Len), len(event.Data))]
+	msg, err := parseDNS(data, event.Protocol == protoTCP)
+	if err != nil {
+		return
+	}
+
+	key := dnsKey{
+		pid:    event.Pid,
+		id:     msg.id,
+		local:  formatAddr(event.Family, event.Laddr, event.Lport),
+		server: formatAddr(event.Family, event.Raddr, event.Rport),
+	}
+	ts := time.Duration(event.Timestamp)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !msg.response {
+		// Retransmitted queries keep the time of the first attempt
+		if _, ok := l.pending[key]; ok {
+			return
+		}
+		protocol := "udp"
+		if event.Protocol == protoTCP {
+			protocol = "tcp"
+		}
+		l.pending[key] = pendingDNS{
+			query: types.DNSQuery{
+				Time:     base.Add(ts),
+				Name:     msg.name,
+				Type:     dnsTypeName(msg.qtype),
+				Server:   key.server,
+				Protocol: protocol,
+			},
+			sent: ts,
+		}
+		return
+	}
+
+	p, ok := l.pending[key]
+	if !ok {
+		return
+	}
+	delete(l.pending, key)
+	p.query.RCode = dnsRCodeName(msg.rcode)
+	p.query.Latency = ts - p.sent
+	l.add(key.pid, p.query)
+}
+
+// expire logs queries that went unanswered for dnsTimeout as timed out.
+// now is the current monotonic time.
+func (l *dnsLog) expire(now time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, p := range l.pending {
+		if now-p.sent < dnsTimeout {
+			continue
+		}
+		delete(l.pending, key)
+		p.query.RCode = types.DNSTimeout
+		l.add(key.pid, p.query)
+	}
+}
+
+// add appends a completed query to the log of pid, dropping the oldest
+// beyond dnsLogLen
+func (l *dnsLog) add(pid uint32, query types.DNSQuery) {
+	queries := append(l.queries[pid], query)
+	if len(queries) > dnsLogLen {
+		queries = queries[len(queries)-dnsLogLen:]
+	}
+	l.queries[pid] = queries
+}
+
+// get returns the recent queries of pid, oldest first
+func (l *dnsLog) get(pid uint32) []types.DNSQuery {
+	l.expire(monotonicNow())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]types.DNSQuery(nil), l.queries[pid]...)
+}
+
+// clear forgets the queries of pid, including unanswered ones
+func (l *dnsLog) clear(pid uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.queries, pid)
+	for key := range l.pending {
+		if key.pid == pid {
+			delete(l.pending, key)
+		}
+	}
+}
+
+// readDNS starts feeding DNS messages from the kernel ring buffer to the
+// DNS log
+func (nm *NetworkMonitor) readDNS() error {
+	err := nm.readRing(nm.maps.DnsEvents, func(raw []byte) bool {
+		var event netmonDnsEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &event); err != nil {
+			return true
+		}
+		nm.dns.record(&event, time.Now().Add(-monotonicNow()))
+		return true
+	}, func() {})
+	if err != nil {
+		return fmt.Errorf("failed to open DNS ring buffer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// dnsQueryMsg is a query for www.example.com AAAA with ID 0x1234
+var dnsQueryMsg = []byte{
+	0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+	0x00, 0x1c, 0x00, 0x01,
+}
+
+// dnsResponse returns the response to dnsQueryMsg with the given rcode
+func dnsResponse(rcode byte) []byte {
+	msg := append([]byte(nil), dnsQueryMsg...)
+	msg[2] = 0x81
+	msg[3] = 0x80 | rcode
+	return msg
+}
+
+func TestParseDNS(t *testing.T) {
+	msg, err := parseDNS(dnsQueryMsg, false)
+	if err != nil {
+		t.Fatalf("parseDNS failed: %v", err)
+	}
+	if msg.id != 0x1234 || msg.response || msg.name != "www.example.com" || dnsTypeName(msg.qtype) != "AAAA" {
+		t.Errorf("query = %+v", msg)
+	}
+
+	// TCP messages carry a length prefix
+	tcp := append([]byte{0, byte(len(dnsQueryMsg))}, dnsResponse(3)...)
+	msg, err = parseDNS(tcp, true)
+	if err != nil {
+		t.Fatalf("parseDNS failed on TCP: %v", err)
+	}
+	if !msg.response || dnsRCodeName(msg.rcode) != "NXDOMAIN" || msg.name != "www.example.com" {
+		t.Errorf("TCP response = %+v", msg)
+	}
+
+	if _, err := parseDNS(dnsQueryMsg[:20], false); err == nil {
+		t.Error("Expected error for truncated message")
+	}
+
+	// A name pointing at itself
+	loop := append(append([]byte(nil), dnsQueryMsg[:12]...), 0xc0, 12, 0, 1, 0, 1)
+	if _, err := parseDNS(loop, false); err == nil {
+		t.Error("Expected error for compression loop")
+	}
+}
+
+// dnsEvent builds a captured DNS message between 10.0.0.1:40000 and 10.0.0.53:53
+func dnsEvent(data []byte, ts time.Duration, ingress bool) *netmonDnsEvent {
+	event := &netmonDnsEvent{
+		Timestamp: uint64(ts),
+		Pid:       42,
+		Len:       uint16(len(data)),
+		Protocol:  protoUDP,
+		Family:    afInet,
+		Lport:     40000,
+		Rport:     53,
+	}
+	if ingress {
+		event.Ingress = 1
+	}
+	copy(event.Laddr[:], []byte{10, 0, 0, 1})
+	copy(event.Raddr[:], []byte{10, 0, 0, 53})
+	copy(event.Data[:], data)
+	return event
+}
+
+func TestDNSLog(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	l := newDNSLog()
+
+	l.record(dnsEvent(dnsQueryMsg, time.Second, false), base)
+	// A retransmission does not reset the query time
+	l.record(dnsEvent(dnsQueryMsg, time.Second+10*time.Millisecond, false), base)
+	l.record(dnsEvent(dnsResponse(0), time.Second+20*time.Millisecond, true), base)
+
+	queries := l.queries[42]
+	if len(queries) != 1 {
+		t.Fatalf("Expected 1 query, got %d", len(queries))
+	}
+	want := types.DNSQuery{
+		Time:     base.Add(time.Second),
+		Name:     "www.example.com",
+		Type:     "AAAA",
+		RCode:    "NOERROR",
+		Latency:  20 * time.Millisecond,
+		Server:   "10.0.0.53:53",
+		Protocol: "udp",
+	}
+	if queries[0] != want {
+		t.Errorf("query = %+v, want %+v", queries[0], want)
+	}
+
+	// Unanswered queries time out
+	l.record(dnsEvent(dnsQueryMsg, 10*time.Second, false), base)
+	l.expire(10*time.Second + dnsTimeout - 1)
+	if len(l.queries[42]) != 1 {
+		t.Fatalf("Expected pending query before timeout")
+	}
+	l.expire(10*time.Second + dnsTimeout)
+	if got := l.queries[42]; len(got) != 2 || got[1].RCode != types.DNSTimeout {
+		t.Errorf("Expected timed out query, got %+v", got)
+	}
+
+	l.clear(42)
+	if len(l.queries[42]) != 0 || len(l.pending) != 0 {
+		t.Errorf("Expected empty log after clear")
+	}
+}
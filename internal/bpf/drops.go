@@ -0,0 +1,99 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// dropReasonPrefix is the common prefix of enum skb_drop_reason values
+const dropReasonPrefix = "SKB_DROP_REASON_"
+
+var (
+	dropReasonsOnce sync.Once
+	dropReasons     map[uint32]string
+)
+
+// dropReasonName returns the name of a kernel drop reason, e.g.
+// "NO_SOCKET". Names are read from the running kernel's BTF, since the
+// numbering differs between kernel versions.
+func dropReasonName(reason uint32) string {
+	dropReasonsOnce.Do(func() {
+		dropReasons = loadDropReasons()
+	})
+	if name, ok := dropReasons[reason]; ok {
+		return name
+	}
+	return fmt.Sprintf("REASON_%d", reason)
+}
+
+// loadDropReasons reads the values of enum skb_drop_reason from kernel BTF
+func loadDropReasons() map[uint32]string {
+	reasons := make(map[uint32]string)
+
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return reasons
+	}
+	var enum *btf.Enum
+	if err := spec.TypeByName("skb_drop_reason", &enum); err != nil {
+		return reasons
+	}
+	for _, v := range enum.Values {
+		reasons[uint32(v.Value)] = strings.TrimPrefix(v.Name, dropReasonPrefix)
+	}
+	return reasons
+}
+
+// getDrops returns the dropped packets of each of pids per drop reason, in
+// a single pass over the kernel map
+func (nm *NetworkMonitor) getDrops(pids []uint32) (map[uint32]map[string]uint64, error) {
+	drops := make(map[uint32]map[string]uint64, len(pids))
+	for _, pid := range pids {
+		drops[pid] = make(map[string]uint64)
+	}
+
+	var (
+		key   netmonDropKey
+		count uint64
+	)
+	iter := nm.maps.Drops.Iterate()
+	for iter.Next(&key, &count) {
+		if reasons, ok := drops[key.Pid]; ok {
+			reasons[dropReasonName(key.Reason)] += count
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate drops: %w", err)
+	}
+	return drops, nil
+}
+
+// clearDrops removes the drop counters of pid
+func (nm *NetworkMonitor) clearDrops(pid uint32) error {
+	var (
+		key   netmonDropKey
+		count uint64
+		stale []netmonDropKey
+	)
+	iter := nm.maps.Drops.Iterate()
+	for iter.Next(&key, &count) {
+		if key.Pid == pid {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to iterate drops: %w", err)
+	}
+
+	for i := range stale {
+		if err := nm.maps.Drops.Delete(&stale[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to clear drops: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package bpf
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDropReasonName(t *testing.T) {
+	if got := dropReasonName(1 << 30); got != "REASON_1073741824" {
+		t.Errorf("Expected fallback name for unknown reason, got %s", got)
+	}
+
+	if _, err := os.Stat("/sys/kernel/btf/vmlinux"); err != nil {
+		t.Skip("kernel BTF not available")
+	}
+	// SKB_DROP_REASON_NOT_SPECIFIED has been 2 since drop reasons were added
+	if got := dropReasonName(2); got != "NOT_SPECIFIED" {
+		t.Errorf("Expected NOT_SPECIFIED for reason 2, got %s", got)
+	}
+}
@@ -0,0 +1,113 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// eventQueueLen is the number of connection events buffered for the consumer
+const eventQueueLen = 256
+
+// Connection event types as reported by the kernel
+const (
+	connEventConnect = 1
+	connEventAccept  = 2
+	connEventClose   = 3
+)
+
+// Events returns the connection lifecycle events of monitored processes.
+// Events are only delivered if enabled with Config.Events; the channel is
+// closed when the monitor is stopped.
+func (nm *NetworkMonitor) Events() <-chan types.ConnEvent {
+	return nm.events
+}
+
+// readEvents starts delivering connection events from the kernel ring buffer
+func (nm *NetworkMonitor) readEvents() error {
+	err := nm.readRing(nm.maps.ConnEvents, func(raw []byte) bool {
+		var event netmonConnEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &event); err != nil {
+			return true
+		}
+		select {
+		case nm.events <- connEvent(&event, time.Now().Add(-monotonicNow())):
+			return true
+		case <-nm.stopRead:
+			return false
+		}
+	}, func() { close(nm.events) })
+	if err != nil {
+		return fmt.Errorf("failed to open event ring buffer: %w", err)
+	}
+	return nil
+}
+
+// connEvent converts a kernel connection event. base is the wall clock time
+// corresponding to monotonic time zero.
+func connEvent(event *netmonConnEvent, base time.Time) types.ConnEvent {
+	ev := types.ConnEvent{
+		Time:       base.Add(time.Duration(event.Timestamp)),
+		PID:        int32(event.Pid),
+		Comm:       commString(event.Comm),
+		LocalAddr:  formatAddr(event.Family, event.Laddr, event.Lport),
+		RemoteAddr: formatAddr(event.Family, event.Raddr, event.Rport),
+	}
+
+	switch event.Type {
+	case connEventConnect:
+		ev.Type = types.ConnConnect
+	case connEventAccept:
+		ev.Type = types.ConnAccept
+	case connEventClose:
+		ev.Type = types.ConnClose
+		ev.Duration = time.Duration(event.Duration)
+		ev.BytesIn = event.BytesIn
+		ev.BytesOut = event.BytesOut
+		ev.PacketsIn = event.PacketsIn
+		ev.PacketsOut = event.PacketsOut
+	}
+
+	switch event.Protocol {
+	case protoTCP:
+		ev.Protocol = "tcp"
+	case protoUDP:
+		ev.Protocol = "udp"
+	}
+
+	// Close events raised in softirq carry no process name
+	if ev.Comm == "" {
+		ev.Comm = readComm(event.Pid)
+	}
+
+	return ev
+}
+
+// commString converts a NUL-terminated kernel task name
+func commString(comm [16]int8) string {
+	var b strings.Builder
+	for _, c := range comm {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	return b.String()
+}
+
+// readComm reads the name of a process from procfs, or returns "" if the
+// process is gone
+func readComm(pid uint32) string {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.FormatUint(uint64(pid), 10), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,41 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+func TestConnEvent(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	event := netmonConnEvent{
+		Timestamp: uint64(5 * time.Second),
+		Duration:  uint64(4200 * time.Millisecond),
+		BytesIn:   1000,
+		BytesOut:  200,
+		Pid:       99,
+		Type:      connEventClose,
+		Protocol:  protoTCP,
+		Family:    afInet,
+		Laddr:     [16]uint8{10, 0, 0, 2},
+		Raddr:     [16]uint8{1, 2, 3, 4},
+		Lport:     51234,
+		Rport:     443,
+	}
+	copy(event.Comm[:], []int8{'c', 'u', 'r', 'l'})
+
+	ev := connEvent(&event, base)
+	if ev.Type != types.ConnClose || ev.PID != 99 || ev.Comm != "curl" || ev.Protocol != "tcp" {
+		t.Errorf("event = %+v", ev)
+	}
+	if ev.LocalAddr != "10.0.0.2:51234" || ev.RemoteAddr != "1.2.3.4:443" {
+		t.Errorf("addresses = %s -> %s", ev.LocalAddr, ev.RemoteAddr)
+	}
+	if !ev.Time.Equal(base.Add(5*time.Second)) || ev.Duration != 4200*time.Millisecond {
+		t.Errorf("time = %v, duration = %v", ev.Time, ev.Duration)
+	}
+	if ev.BytesIn != 1000 || ev.BytesOut != 200 {
+		t.Errorf("bytes = %d/%d, want 1000/200", ev.BytesIn, ev.BytesOut)
+	}
+}
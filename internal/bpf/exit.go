@@ -0,0 +1,134 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// exitQueueLen is the number of exit records buffered for the consumer
+const exitQueueLen = 64
+
+// ProcessExit holds the final statistics of a monitored process that exited
+type ProcessExit struct {
+	PID   uint32
+	Stats types.NetworkStats
+}
+
+// Exits returns the final statistics of exited processes. The channel is
+// closed when the monitor is stopped.
+func (nm *NetworkMonitor) Exits() <-chan ProcessExit {
+	return nm.exits
+}
+
+// readExits starts delivering exit records from the kernel ring buffer
+func (nm *NetworkMonitor) readExits() error {
+	err := nm.readRing(nm.maps.Exits, func(raw []byte) bool {
+		var event netmonExitEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &event); err != nil {
+			return true
+		}
+		select {
+		case nm.exits <- nm.processExit(&event):
+			return true
+		case <-nm.stopRead:
+			return false
+		}
+	}, func() { close(nm.exits) })
+	if err != nil {
+		return fmt.Errorf("failed to open exit ring buffer: %w", err)
+	}
+	return nil
+}
+
+// readRing reads records from a ring buffer map in the background, passing
+// each to handle until it returns false or Stop closes the reader. done is
+// called when reading ends.
+func (nm *NetworkMonitor) readRing(m *ebpf.Map, handle func(raw []byte) bool, done func()) error {
+	rd, err := ringbuf.NewReader(m)
+	if err != nil {
+		return err
+	}
+	nm.readers = append(nm.readers, rd)
+
+	go func() {
+		defer done()
+		for {
+			// Fails once the reader is closed by Stop
+			record, err := rd.Read()
+			if err != nil {
+				return
+			}
+			if !handle(record.RawSample) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// processExit builds the final statistics of an exited process, including
+// its per-interface and drop counters, histograms, DNS queries and HTTP
+// statistics, which are forgotten afterwards
+func (nm *NetworkMonitor) processExit(event *netmonExitEvent) ProcessExit {
+	stats := nm.networkStats(&event.Stats)
+
+	ifaces, err := nm.getInterfaceStats(event.Pid)
+	if err == nil {
+		stats.Interfaces = ifaces
+	}
+	nm.clearInterfaceStats(event.Pid)
+
+	drops, err := nm.getDrops([]uint32{event.Pid})
+	if err == nil {
+		stats.Drops = drops[event.Pid]
+	}
+	nm.clearDrops(event.Pid)
+
+	if nm.histograms {
+		stats.Histograms, _ = nm.getHistograms(event.Pid)
+	}
+	nm.clearHistograms(event.Pid)
+
+	if nm.dns != nil {
+		stats.DNS = nm.dns.get(event.Pid)
+		nm.dns.clear(event.Pid)
+	}
+	if nm.http != nil {
+		stats.HTTP = nm.http.get(event.Pid)
+		nm.http.clear(event.Pid)
+	}
+
+	return ProcessExit{PID: event.Pid, Stats: stats}
+}
+
+// clearInterfaceStats removes the per-interface statistics of a process,
+// including those of interfaces no longer attached
+func (nm *NetworkMonitor) clearInterfaceStats(pid uint32) error {
+	var (
+		key    netmonIfaceKey
+		percpu []netmonTrafficStats
+		stale  []netmonIfaceKey
+	)
+	iter := nm.maps.IfaceStats.Iterate()
+	for iter.Next(&key, &percpu) {
+		if key.Pid == pid {
+			stale = append(stale, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to iterate interface stats: %w", err)
+	}
+
+	for i := range stale {
+		if err := nm.maps.IfaceStats.Delete(&stale[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to clear interface stats: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+	"github.com/cilium/ebpf"
+)
+
+// Directions indexing the kernel histograms
+const (
+	histIngress = 0
+	histEgress  = 1
+)
+
+// getHistograms returns the packet size and inter-arrival histograms of pid,
+// or nil if it sent or received no packets yet
+func (nm *NetworkMonitor) getHistograms(pid uint32) (*types.Histograms, error) {
+	var h netmonHistograms
+	if err := nm.maps.Histograms.Lookup(pid, &h); err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to lookup histograms: %w", err)
+	}
+	return &types.Histograms{
+		SizeIn:  histogram(h.Size[histIngress]),
+		SizeOut: histogram(h.Size[histEgress]),
+		GapIn:   histogram(h.Gap[histIngress]),
+		GapOut:  histogram(h.Gap[histEgress]),
+	}, nil
+}
+
+// clearHistograms removes the histograms of pid
+func (nm *NetworkMonitor) clearHistograms(pid uint32) error {
+	if err := nm.maps.Histograms.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to clear histograms: %w", err)
+	}
+	return nil
+}
+
+// histogram converts kernel histogram buckets, leaving out trailing empty
+// buckets
+func histogram(buckets [32]uint64) types.Histogram {
+	n := len(buckets)
+	for n > 0 && buckets[n-1] == 0 {
+		n--
+	}
+	return append(types.Histogram(nil), buckets[:n]...)
+}
@@ -0,0 +1,32 @@
+package bpf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	var buckets [32]uint64
+	buckets[0] = 1
+	buckets[6] = 10 // 64-127 bytes
+	buckets[10] = 3 // 1024-2047 bytes
+
+	h := histogram(buckets)
+	if len(h) != 11 {
+		t.Fatalf("Expected 11 buckets up to the last non-empty one, got %d", len(h))
+	}
+	if h[0] != 1 || h[6] != 10 || h[10] != 3 {
+		t.Errorf("histogram = %v", h)
+	}
+
+	if h := histogram([32]uint64{}); len(h) != 0 {
+		t.Errorf("Expected empty histogram, got %v", h)
+	}
+
+	// Adding histograms of different lengths
+	sum := histogram([32]uint64{1: 2})
+	sum.Add(h)
+	if !slices.Equal(sum, []uint64{1, 2, 0, 0, 0, 0, 10, 0, 0, 0, 3}) {
+		t.Errorf("sum = %v", sum)
+	}
+}
@@ -0,0 +1,233 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+const (
+	// httpPathDepth is the number of path segments requests are grouped by
+	httpPathDepth = 2
+	// httpMaxPaths bounds the path prefixes tracked per process; further
+	// requests are counted under httpOtherPath
+	httpMaxPaths  = 64
+	httpOtherPath = "(other)"
+)
+
+// httpMethods are the request methods recognised by the kernel
+var httpMethods = map[string]bool{
+	"GET":     true,
+	"POST":    true,
+	"PUT":     true,
+	"HEAD":    true,
+	"DELETE":  true,
+	"PATCH":   true,
+	"OPTIONS": true,
+}
+
+// httpMessage is a parsed HTTP/1.x request line or status line
+type httpMessage struct {
+	method string // Set for requests
+	path   string // Path prefix of requests
+	status string // Set for responses
+}
+
+// parseHTTP parses the request line or status line at the start of a
+// captured HTTP/1.x message, which may be cut short
+func parseHTTP(data []byte) (httpMessage, bool) {
+	var msg httpMessage
+
+	line := string(data)
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+
+	if strings.HasPrefix(line, "HTTP/1.") {
+		if len(fields) < 2 || len(fields[1]) != 3 || strings.Trim(fields[1], "0123456789") != "" {
+			return msg, false
+		}
+		msg.status = fields[1]
+		return msg, true
+	}
+
+	if len(fields) < 2 || !httpMethods[fields[0]] {
+		return msg, false
+	}
+	msg.method = fields[0]
+	msg.path = httpPathPrefix(fields[1])
+	return msg, true
+}
+
+// httpPathPrefix reduces a request target to its first httpPathDepth path
+// segments, without query or fragment
+func httpPathPrefix(target string) string {
+	// Absolute form, as sent to proxies
+	if i := strings.Index(target, "://"); i >= 0 {
+		target = target[i+3:]
+		if j := strings.IndexByte(target, '/'); j >= 0 {
+			target = target[j:]
+		} else {
+			target = "/"
+		}
+	}
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		target = target[:i]
+	}
+	if !strings.HasPrefix(target, "/") {
+		return target // Asterisk or authority form
+	}
+
+	segments := strings.SplitN(target[1:], "/", httpPathDepth+1)
+	if len(segments) > httpPathDepth {
+		segments = segments[:httpPathDepth]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// pendingHTTP is a request whose size is not known yet
+type pendingHTTP struct {
+	path  string
+	start uint64 // Bytes on the connection before the request
+}
+
+// httpLog aggregates the HTTP/1.x messages of monitored processes
+type httpLog struct {
+	mu      sync.Mutex
+	pending map[netmonConnKey]pendingHTTP
+	stats   map[uint32]*types.HTTPStats
+}
+
+func newHTTPLog() *httpLog {
+	return &httpLog{
+		pending: make(map[netmonConnKey]pendingHTTP),
+		stats:   make(map[uint32]*types.HTTPStats),
+	}
+}
+
+// record handles an HTTP message captured by the kernel
+func (l *httpLog) record(event *netmonHttpEvent) {
+	msg, ok := parseHTTP(event.Data[:min(int(event.Len), len(event.Data))])
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := l.stats[event.Key.Pid]
+	if stats == nil {
+		stats = &types.HTTPStats{
+			Methods:  make(map[string]uint64),
+			Statuses: make(map[string]uint64),
+			Paths:    make(map[string]types.HTTPPathStats),
+		}
+		l.stats[event.Key.Pid] = stats
+	}
+
+	if msg.status != "" {
+		stats.Responses++
+		stats.Statuses[msg.status]++
+		return
+	}
+
+	// A new request on the connection ends the previous one
+	l.finish(event.Key, event.ConnBytes)
+
+	path := msg.path
+	if _, ok := stats.Paths[path]; !ok && len(stats.Paths) >= httpMaxPaths {
+		path = httpOtherPath
+	}
+	p := stats.Paths[path]
+	p.Requests++
+	stats.Paths[path] = p
+	stats.Requests++
+	stats.Methods[msg.method]++
+	l.pending[event.Key] = pendingHTTP{path: path, start: event.ConnBytes}
+}
+
+// finish accounts the bytes of the pending request on a connection, given
+// the bytes on the connection at its end. l.mu must be held.
+func (l *httpLog) finish(key netmonConnKey, connBytes uint64) {
+	req, ok := l.pending[key]
+	if !ok {
+		return
+	}
+	delete(l.pending, key)
+
+	stats := l.stats[key.Pid]
+	if stats == nil || connBytes < req.start {
+		return
+	}
+	p := stats.Paths[req.path]
+	p.Bytes += connBytes - req.start
+	stats.Paths[req.path] = p
+}
+
+// connectionEnded accounts the last request of a connection that closed
+// or expired
+func (l *httpLog) connectionEnded(key netmonConnKey, connBytes uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.finish(key, connBytes)
+}
+
+// get returns a copy of the HTTP statistics of pid, or nil if none were seen
+func (l *httpLog) get(pid uint32) *types.HTTPStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := l.stats[pid]
+	if stats == nil {
+		return nil
+	}
+	result := *stats
+	result.Methods = make(map[string]uint64, len(stats.Methods))
+	for method, n := range stats.Methods {
+		result.Methods[method] = n
+	}
+	result.Statuses = make(map[string]uint64, len(stats.Statuses))
+	for status, n := range stats.Statuses {
+		result.Statuses[status] = n
+	}
+	result.Paths = make(map[string]types.HTTPPathStats, len(stats.Paths))
+	for path, p := range stats.Paths {
+		result.Paths[path] = p
+	}
+	return &result
+}
+
+// clear forgets the HTTP statistics of pid
+func (l *httpLog) clear(pid uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.stats, pid)
+	for key := range l.pending {
+		if key.Pid == pid {
+			delete(l.pending, key)
+		}
+	}
+}
+
+// readHTTP starts feeding HTTP messages from the kernel ring buffer to the
+// HTTP log
+func (nm *NetworkMonitor) readHTTP() error {
+	err := nm.readRing(nm.maps.HttpEvents, func(raw []byte) bool {
+		var event netmonHttpEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &event); err != nil {
+			return true
+		}
+		nm.http.record(&event)
+		return true
+	}, func() {})
+	if err != nil {
+		return fmt.Errorf("failed to open HTTP ring buffer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package bpf
+
+import "testing"
+
+func TestParseHTTP(t *testing.T) {
+	tests := []struct {
+		data string
+		want httpMessage
+		ok   bool
+	}{
+		{"GET /api/v1/users/42?full=1 HTTP/1.1\r\nHost: x\r\n", httpMessage{method: "GET", path: "/api/v1"}, true},
+		{"POST /login HTTP/1.1\r\n", httpMessage{method: "POST", path: "/login"}, true},
+		{"GET http://example.com/a/b/c HTTP/1.1\r\n", httpMessage{method: "GET", path: "/a/b"}, true},
+		{"OPTIONS * HTTP/1.1\r\n", httpMessage{method: "OPTIONS", path: "*"}, true},
+		{"GET /very/long/path/cut", httpMessage{method: "GET", path: "/very/long"}, true},
+		{"HTTP/1.1 404 Not Found\r\n", httpMessage{status: "404"}, true},
+		{"HTTP/1.0 2OO OK\r\n", httpMessage{}, false},
+		{"GETS / HTTP/1.1\r\n", httpMessage{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseHTTP([]byte(tt.data))
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseHTTP(%q) = %+v, %v; want %+v, %v", tt.data, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// httpEvent builds a captured HTTP message on a connection of PID 42
+func httpEvent(lport uint16, data string, connBytes uint64) *netmonHttpEvent {
+	event := &netmonHttpEvent{
+		Key:       netmonConnKey{Pid: 42, Family: afInet, Protocol: protoTCP, Lport: lport, Rport: 80},
+		Len:       uint16(len(data)),
+		ConnBytes: connBytes,
+	}
+	copy(event.Data[:], data)
+	return event
+}
+
+func TestHTTPLog(t *testing.T) {
+	l := newHTTPLog()
+
+	// Two requests on a keep-alive connection, one on another
+	l.record(httpEvent(40000, "GET /api/v1/users HTTP/1.1\r\n", 0))
+	l.record(httpEvent(40000, "HTTP/1.1 200 OK\r\n", 200))
+	l.record(httpEvent(40000, "POST /api/v1/users HTTP/1.1\r\n", 5000))
+	l.record(httpEvent(40000, "HTTP/1.1 201 Created\r\n", 5300))
+	l.record(httpEvent(40001, "GET /health HTTP/1.1\r\n", 0))
+	l.connectionEnded(netmonConnKey{Pid: 42, Family: afInet, Protocol: protoTCP, Lport: 40000, Rport: 80}, 5500)
+
+	stats := l.get(42)
+	if stats == nil {
+		t.Fatal("Expected HTTP stats for PID 42")
+	}
+	if stats.Requests != 3 || stats.Responses != 2 {
+		t.Errorf("requests/responses = %d/%d, want 3/2", stats.Requests, stats.Responses)
+	}
+	if stats.Methods["GET"] != 2 || stats.Methods["POST"] != 1 {
+		t.Errorf("methods = %v", stats.Methods)
+	}
+	if stats.Statuses["200"] != 1 || stats.Statuses["201"] != 1 {
+		t.Errorf("statuses = %v", stats.Statuses)
+	}
+	if p := stats.Paths["/api/v1"]; p.Requests != 2 || p.Bytes != 5500 {
+		t.Errorf("/api/v1 = %+v, want 2 requests, 5500 bytes", p)
+	}
+	// Still running
+	if p := stats.Paths["/health"]; p.Requests != 1 || p.Bytes != 0 {
+		t.Errorf("/health = %+v, want 1 request, 0 bytes", p)
+	}
+
+	l.clear(42)
+	if l.get(42) != nil || len(l.pending) != 0 {
+		t.Error("Expected no HTTP stats after clear")
+	}
+}
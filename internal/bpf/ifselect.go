@@ -0,0 +1,67 @@
+package bpf
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// interfaceSelector decides which interfaces are monitored. Patterns are
+// interface names or shell globs such as "eth*"; a leading "!" excludes
+// matching interfaces. Without any inclusive pattern every interface that is
+// not excluded is selected.
+type interfaceSelector struct {
+	include []string
+	exclude []string
+}
+
+// newInterfaceSelector validates and compiles a list of interface patterns
+func newInterfaceSelector(patterns []string) (*interfaceSelector, error) {
+	sel := &interfaceSelector{}
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		list := &sel.include
+		if strings.HasPrefix(p, "!") {
+			p = p[1:]
+			list = &sel.exclude
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q: %w", p, err)
+		}
+		*list = append(*list, p)
+	}
+	return sel, nil
+}
+
+// Match reports whether the interface called name is selected
+func (sel *interfaceSelector) Match(name string) bool {
+	for _, p := range sel.exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+	if len(sel.include) == 0 {
+		return true
+	}
+	for _, p := range sel.include {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// named reports whether the interface called name is given by its exact
+// name rather than matched by a pattern
+func (sel *interfaceSelector) named(name string) bool {
+	for _, p := range sel.include {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package bpf
+
+import "testing"
+
+func TestInterfaceSelector(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		expected bool
+	}{
+		{nil, "eth0", true},
+		{[]string{"!lo"}, "eth0", true},
+		{[]string{"!lo"}, "lo", false},
+		{[]string{"eth*", "wg0"}, "eth1", true},
+		{[]string{"eth*", "wg0"}, "wg0", true},
+		{[]string{"eth*", "wg0"}, "veth12ab", false},
+		{[]string{"*eth*", "!veth*"}, "veth12ab", false},
+		{[]string{"*eth*", "!veth*"}, "eth0", true},
+	}
+
+	for _, test := range tests {
+		sel, err := newInterfaceSelector(test.patterns)
+		if err != nil {
+			t.Fatalf("newInterfaceSelector(%v) failed: %v", test.patterns, err)
+		}
+		if got := sel.Match(test.name); got != test.expected {
+			t.Errorf("Match(%q) with %v = %v; expected %v", test.name, test.patterns, got, test.expected)
+		}
+	}
+}
+
+func TestInterfaceSelectorInvalid(t *testing.T) {
+	if _, err := newInterfaceSelector([]string{"eth["}); err == nil {
+		t.Error("Expected error for malformed pattern")
+	}
+}
+
+func TestInterfaceSelectorNamed(t *testing.T) {
+	sel, err := newInterfaceSelector([]string{"eth*", "wg0", "!lo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"wg0": true, "eth0": false, "lo": false} {
+		if got := sel.named(name); got != expected {
+			t.Errorf("named(%q) = %v; expected %v", name, got, expected)
+		}
+	}
+}
@@ -1,30 +1,119 @@
 package bpf
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bkohler/procnetmon2/pkg/types"
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
 	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
 	"github.com/cilium/ebpf/rlimit"
-	"github.com/vishvananda/netlink"
 )
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang netmon ./c/netmon.c -- -I/usr/include/bpf
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -type conn_event -type dns_event -type exit_event -type http_event -type tls_event netmon ./c/netmon.c -- -I/usr/include/bpf
 
 // NetworkMonitor represents the eBPF program and its resources
 type NetworkMonitor struct {
-	programs    *netmonPrograms
-	maps        *netmonMaps
-	tcIngress   link.Link
-	tcEgress    link.Link
-	interfaceID uint32
+	programs     *netmonPrograms
+	maps         *netmonMaps
+	tracing      []link.Link // Socket ownership and process lifecycle hooks
+	selector     *interfaceSelector
+	connTimeout  time.Duration
+	attribution  Attribution
+	accounting   Accounting
+	histograms   bool // Packet histograms are tracked
+	acceptHooked bool // The accept hook matches the running kernel
+
+	// Instrumented interfaces
+	mu       sync.Mutex
+	attached map[int]*tcAttachment // Keyed by interface index
+	closed   bool                  // Set once Stop has detached everything
+	linkDone chan struct{}         // Stops the link watcher
+
+	// Ring buffer consumers
+	readers  []*ringbuf.Reader
+	stopRead chan struct{} // Stops delivery to abandoned consumers
+	exits    chan ProcessExit
+	events   chan types.ConnEvent
+	dns      *dnsLog  // Set if DNS capture is enabled
+	http     *httpLog // Set if HTTP sniffing is enabled
+
+	// TLS server names of tracked connections, set if TLS capture is enabled
+	sniMu sync.Mutex
+	sni   map[netmonConnKey]string
 }
 
 // Config holds configuration for the network monitor
 type Config struct {
-	Interface string // Interface to monitor (empty for all)
+	Interfaces  []string      // Interface names, globs or "!"-prefixed exclusions (empty for all)
+	ConnTimeout time.Duration // Idle time after which connections expire (default: 2m)
+	AccountAll  bool          // Account every process, not only those added with AddPID
+	Attribution Attribution   // Which process traffic is accounted to (default: AttributeTree)
+	Events      bool          // Stream connection lifecycle events through Events
+	Accounting  Accounting    // Layers traffic is counted at (default: AccountWire)
+	DNS         bool          // Log DNS queries of monitored processes; requires wire accounting
+	HTTP        bool          // Sniff plaintext HTTP/1.x of monitored processes; requires wire accounting
+	TLS         bool          // Record TLS server names of outgoing connections; requires wire accounting
+	Histograms  bool          // Track packet size and inter-arrival histograms; requires wire accounting
+	Decapsulate bool          // Account the inner flows of VXLAN, Geneve and GRE packets
+	Cgroups     bool          // Account traffic of cgroups added with AddCgroup
+}
+
+// Accounting selects the layers at which traffic is counted
+type Accounting int
+
+const (
+	// AccountWire counts packets on the wire with TC hooks on the monitored
+	// interfaces, including protocol headers
+	AccountWire Accounting = 1 << iota
+	// AccountSocket counts application payload at the socket send and
+	// receive calls, on any interface including loopback
+	AccountSocket
+)
+
+// ParseAccounting parses an accounting mode name: "wire", "socket" or "both"
+func ParseAccounting(name string) (Accounting, error) {
+	switch name {
+	case "wire":
+		return AccountWire, nil
+	case "socket":
+		return AccountSocket, nil
+	case "both":
+		return AccountWire | AccountSocket, nil
+	default:
+		return 0, fmt.Errorf("unknown accounting mode %q (want wire, socket or both)", name)
+	}
+}
+
+// Attribution selects the process that traffic is accounted to. Threads are
+// always accounted with their process.
+type Attribution int
+
+const (
+	// AttributeTree rolls descendants of a monitored process up to it, at any depth
+	AttributeTree Attribution = iota
+	// AttributeProcess accounts each process (TGID) on its own
+	AttributeProcess
+)
+
+// ParseAttribution parses an attribution mode name: "tree" or "process"
+func ParseAttribution(name string) (Attribution, error) {
+	switch name {
+	case "tree":
+		return AttributeTree, nil
+	case "process":
+		return AttributeProcess, nil
+	default:
+		return 0, fmt.Errorf("unknown attribution mode %q (want tree or process)", name)
+	}
 }
 
 // New creates a new NetworkMonitor instance
@@ -35,120 +124,299 @@ func New(cfg Config) (*NetworkMonitor, error) {
 	}
 
 	// Load pre-compiled programs
+	spec, err := loadNetmon()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load objects: %w", err)
+	}
+
+	if err := spec.Variables["account_all"].Set(cfg.AccountAll); err != nil {
+		return nil, fmt.Errorf("failed to configure accounting mode: %w", err)
+	}
+
+	if err := spec.Variables["track_descendants"].Set(cfg.Attribution == AttributeTree); err != nil {
+		return nil, fmt.Errorf("failed to configure attribution mode: %w", err)
+	}
+
+	if err := spec.Variables["emit_events"].Set(cfg.Events); err != nil {
+		return nil, fmt.Errorf("failed to configure connection events: %w", err)
+	}
+
+	if err := spec.Variables["capture_dns"].Set(cfg.DNS); err != nil {
+		return nil, fmt.Errorf("failed to configure DNS capture: %w", err)
+	}
+
+	if err := spec.Variables["capture_http"].Set(cfg.HTTP); err != nil {
+		return nil, fmt.Errorf("failed to configure HTTP sniffing: %w", err)
+	}
+
+	if err := spec.Variables["capture_tls"].Set(cfg.TLS); err != nil {
+		return nil, fmt.Errorf("failed to configure TLS capture: %w", err)
+	}
+
+	if err := spec.Variables["track_histograms"].Set(cfg.Histograms); err != nil {
+		return nil, fmt.Errorf("failed to configure histograms: %w", err)
+	}
+
+	if err := spec.Variables["decapsulate"].Set(cfg.Decapsulate); err != nil {
+		return nil, fmt.Errorf("failed to configure decapsulation: %w", err)
+	}
+
+	if err := spec.Variables["track_cgroups"].Set(cfg.Cgroups); err != nil {
+		return nil, fmt.Errorf("failed to configure cgroup accounting: %w", err)
+	}
+
+	// The accept hook is the only one whose arguments changed across the
+	// supported kernels. Without it, accepted connections go unnoticed
+	// until they carry traffic, which is better than not starting at all.
+	acceptHooked := true
+	if arg, err := acceptReturnArg(); err != nil {
+		log.Printf("not tracking accepted connections: %v", err)
+		stubAccept(spec)
+		acceptHooked = false
+	} else if err := spec.Variables["accept_ret_arg"].Set(arg); err != nil {
+		return nil, fmt.Errorf("failed to configure accept hook: %w", err)
+	}
+
+	cpus, err := ebpf.PossibleCPU()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get number of CPUs: %w", err)
+	}
+	if err := spec.Variables["nr_cpus"].Set(uint32(cpus)); err != nil {
+		return nil, fmt.Errorf("failed to configure number of CPUs: %w", err)
+	}
+
 	objs := netmonObjects{}
-	if err := loadNetmonObjects(&objs, nil); err != nil {
+	if err := spec.LoadAndAssign(&objs, nil); err != nil {
 		return nil, fmt.Errorf("failed to load objects: %w", err)
 	}
 
-	nm := &NetworkMonitor{
-		programs: &objs.netmonPrograms,
-		maps:     &objs.netmonMaps,
+	if cfg.ConnTimeout == 0 {
+		cfg.ConnTimeout = 2 * time.Minute
+	}
+	if cfg.Accounting == 0 {
+		cfg.Accounting = AccountWire
+	}
+	if cfg.DNS && cfg.Accounting&AccountWire == 0 {
+		objs.Close()
+		return nil, errors.New("DNS capture requires wire accounting")
+	}
+	if cfg.HTTP && cfg.Accounting&AccountWire == 0 {
+		objs.Close()
+		return nil, errors.New("HTTP sniffing requires wire accounting")
+	}
+	if cfg.TLS && cfg.Accounting&AccountWire == 0 {
+		objs.Close()
+		return nil, errors.New("TLS capture requires wire accounting")
+	}
+	if cfg.Histograms && cfg.Accounting&AccountWire == 0 {
+		objs.Close()
+		return nil, errors.New("histograms require wire accounting")
 	}
 
-	// Get network interface if specified
-	if cfg.Interface != "" {
-		iface, err := net.InterfaceByName(cfg.Interface)
-		if err != nil {
-			objs.Close()
-			return nil, fmt.Errorf("failed to find interface %s: %w", cfg.Interface, err)
-		}
-		nm.interfaceID = uint32(iface.Index)
+	// Parse interface selection
+	selector, err := newInterfaceSelector(cfg.Interfaces)
+	if err != nil {
+		objs.Close()
+		return nil, err
+	}
 
-		// Enable monitoring for this interface
-		if err := nm.maps.InterfaceFilter.Put(nm.interfaceID, uint8(1)); err != nil {
+	// Interfaces given by exact name must exist
+	for _, name := range selector.include {
+		if strings.ContainsAny(name, "*?[") {
+			continue
+		}
+		if _, err := net.InterfaceByName(name); err != nil {
 			objs.Close()
-			return nil, fmt.Errorf("failed to update interface filter: %w", err)
+			return nil, fmt.Errorf("failed to find interface %s: %w", name, err)
 		}
 	}
 
+	nm := &NetworkMonitor{
+		programs:     &objs.netmonPrograms,
+		maps:         &objs.netmonMaps,
+		selector:     selector,
+		connTimeout:  cfg.ConnTimeout,
+		attribution:  cfg.Attribution,
+		accounting:   cfg.Accounting,
+		histograms:   cfg.Histograms,
+		acceptHooked: acceptHooked,
+		attached:     make(map[int]*tcAttachment),
+		stopRead:     make(chan struct{}),
+		exits:        make(chan ProcessExit, exitQueueLen),
+	}
+	if cfg.Events {
+		nm.events = make(chan types.ConnEvent, eventQueueLen)
+	}
+	if cfg.DNS {
+		nm.dns = newDNSLog()
+	}
+	if cfg.HTTP {
+		nm.http = newHTTPLog()
+	}
+	if cfg.TLS {
+		nm.sni = make(map[netmonConnKey]string)
+	}
+
 	return nm, nil
 }
 
-// Start attaches the eBPF programs to the network interface
+// Start attaches the eBPF programs to the selected interfaces, including
+// matching interfaces created later
 func (nm *NetworkMonitor) Start() error {
-	// Attach TC programs
-	if nm.interfaceID != 0 {
-		// Get interface
-		link, err := netlink.LinkByIndex(int(nm.interfaceID))
-		if err != nil {
-			return fmt.Errorf("failed to get interface: %w", err)
-		}
+	// Attach socket-layer programs used for process attribution
+	if err := nm.attachTracing(); err != nil {
+		return err
+	}
 
-		// Remove existing qdisc if it exists
-		qdiscs, err := netlink.QdiscList(link)
-		if err != nil {
-			return fmt.Errorf("failed to list qdiscs: %w", err)
-		}
+	// Deliver final statistics of exiting processes
+	if err := nm.readExits(); err != nil {
+		return err
+	}
 
-		for _, qdisc := range qdiscs {
-			if qdisc.Type() == "clsact" {
-				if err := netlink.QdiscDel(qdisc); err != nil {
-					return fmt.Errorf("failed to remove existing qdisc: %w", err)
-				}
-				break
-			}
+	// Deliver connection lifecycle events
+	if nm.events != nil {
+		if err := nm.readEvents(); err != nil {
+			return err
 		}
+	}
 
-		// Add qdisc
-		qdisc := &netlink.GenericQdisc{
-			QdiscAttrs: netlink.QdiscAttrs{
-				LinkIndex: link.Attrs().Index,
-				Handle:    netlink.MakeHandle(0xffff, 0),
-				Parent:    netlink.HANDLE_CLSACT,
-			},
-			QdiscType: "clsact",
+	// Log DNS queries
+	if nm.dns != nil {
+		if err := nm.readDNS(); err != nil {
+			return err
 		}
+	}
 
-		if err := netlink.QdiscAdd(qdisc); err != nil {
-			return fmt.Errorf("failed to add qdisc: %w", err)
+	// Sniff HTTP requests and responses
+	if nm.http != nil {
+		if err := nm.readHTTP(); err != nil {
+			return err
 		}
+	}
+
+	// Attach TC programs
+	if nm.accounting&AccountWire == 0 {
+		return nil
+	}
 
-		// Add ingress filter
-		filterIngress := &netlink.BpfFilter{
-			FilterAttrs: netlink.FilterAttrs{
-				LinkIndex: link.Attrs().Index,
-				Parent:    netlink.HANDLE_MIN_INGRESS,
-				Handle:    1,
-				Protocol:  3,
-			},
-			Fd:           nm.programs.TcIngress.FD(),
-			Name:         "ingress",
-			DirectAction: true,
+	// Label outgoing TLS connections with their server names
+	if nm.sni != nil {
+		if err := nm.readTLS(); err != nil {
+			return err
 		}
+	}
+	return nm.attachInterfaces()
+}
 
-		if err := netlink.FilterAdd(filterIngress); err != nil {
-			return fmt.Errorf("failed to add ingress filter: %w", err)
+// attachTracing attaches the programs that record which process owns each
+// socket and how processes are related. Traffic is attributed through these
+// records rather than through whatever task happens to run the TC hook.
+func (nm *NetworkMonitor) attachTracing() error {
+	if nm.acceptHooked {
+		if err := nm.attachTracingProgram(nm.programs.TraceAccept); err != nil {
+			log.Printf("not tracking accepted connections: %v", err)
 		}
+	}
 
-		// Add egress filter
-		filterEgress := &netlink.BpfFilter{
-			FilterAttrs: netlink.FilterAttrs{
-				LinkIndex: link.Attrs().Index,
-				Parent:    netlink.HANDLE_MIN_EGRESS,
-				Handle:    1,
-				Protocol:  3,
-			},
-			Fd:           nm.programs.TcEgress.FD(),
-			Name:         "egress",
-			DirectAction: true,
+	for _, prog := range []*ebpf.Program{
+		nm.programs.TraceFork,
+		nm.programs.TraceExit,
+		nm.programs.TraceSockCreate,
+		nm.programs.TraceTcpConnect,
+		nm.programs.TraceInetSockSetState,
+		nm.programs.TraceSockDestruct,
+		nm.programs.TraceTcpRetransmit,
+		nm.programs.TraceKfreeSkb,
+	} {
+		if err := nm.attachTracingProgram(prog); err != nil {
+			return err
 		}
+	}
 
-		if err := netlink.FilterAdd(filterEgress); err != nil {
-			return fmt.Errorf("failed to add egress filter: %w", err)
+	if nm.accounting&AccountSocket == 0 {
+		return nil
+	}
+	for _, prog := range []*ebpf.Program{
+		nm.programs.TraceTcpSendmsg,
+		nm.programs.TraceTcpRecvmsg,
+		nm.programs.TraceUdpSendmsg,
+		nm.programs.TraceUdpRecvmsg,
+		nm.programs.TraceUdpv6Sendmsg,
+		nm.programs.TraceUdpv6Recvmsg,
+	} {
+		if err := nm.attachTracingProgram(prog); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// acceptReturnArg returns the index of the socket returned by
+// inet_csk_accept in its fexit context, which is one past its last argument.
+// Linux 6.10 folded the flags, err and kern arguments into a struct.
+func acceptReturnArg() (uint32, error) {
+	spec, err := btf.LoadKernelSpec()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load kernel BTF: %w", err)
+	}
+	var fn *btf.Func
+	if err := spec.TypeByName("inet_csk_accept", &fn); err != nil {
+		return 0, fmt.Errorf("failed to find inet_csk_accept: %w", err)
+	}
+	proto, ok := fn.Type.(*btf.FuncProto)
+	if !ok {
+		return 0, fmt.Errorf("inet_csk_accept has unexpected type %s", fn.Type)
+	}
+	switch n := len(proto.Params); n {
+	case 2, 4:
+		return uint32(n), nil
+	default:
+		return 0, fmt.Errorf("unsupported inet_csk_accept with %d arguments", n)
+	}
+}
+
+// stubAccept replaces the accept hook with a program that loads on any
+// kernel, so the remaining programs can load without it. The stub is never
+// attached.
+func stubAccept(spec *ebpf.CollectionSpec) {
+	prog := spec.Programs["trace_accept"]
+	prog.Type = ebpf.SocketFilter
+	prog.AttachType = ebpf.AttachNone
+	prog.AttachTo = ""
+	prog.Instructions = asm.Instructions{
+		asm.Mov.Imm(asm.R0, 0),
+		asm.Return(),
+	}
+}
+
+// attachTracingProgram attaches an fentry/fexit or BTF tracepoint program
+func (nm *NetworkMonitor) attachTracingProgram(prog *ebpf.Program) error {
+	l, err := link.AttachTracing(link.TracingOptions{Program: prog})
+	if err != nil {
+		return fmt.Errorf("failed to attach tracing program: %w", err)
+	}
+	nm.tracing = append(nm.tracing, l)
+	return nil
+}
+
 // Stop detaches the eBPF programs and cleans up resources
 func (nm *NetworkMonitor) Stop() error {
-	if nm.tcIngress != nil {
-		nm.tcIngress.Close()
+	if nm.linkDone != nil {
+		close(nm.linkDone)
+		nm.linkDone = nil
+	}
+	for _, l := range nm.tracing {
+		l.Close()
 	}
-	if nm.tcEgress != nil {
-		nm.tcEgress.Close()
+	if nm.readers != nil {
+		close(nm.stopRead)
+		for _, rd := range nm.readers {
+			rd.Close()
+		}
+		nm.readers = nil
 	}
+	nm.detachAll()
 	if nm.programs != nil {
 		nm.programs.Close()
 	}
@@ -157,27 +425,247 @@ func (nm *NetworkMonitor) Stop() error {
 
 // GetProcessStats retrieves network statistics for a specific PID
 func (nm *NetworkMonitor) GetProcessStats(pid uint32) (*types.NetworkStats, error) {
-	var stats netmonNetworkStats
-	err := nm.maps.ProcessStats.Lookup(pid, &stats)
+	stats, err := nm.GetStatsForPIDs([]uint32{pid})
+	if err != nil {
+		return nil, err
+	}
+	return stats[pid], nil
+}
+
+// GetStatsForPIDs retrieves network statistics for several PIDs, reading
+// the connection and drop tables once for all of them. PIDs without
+// statistics are left out of the result.
+func (nm *NetworkMonitor) GetStatsForPIDs(pids []uint32) (map[uint32]*types.NetworkStats, error) {
+	conns, err := nm.getConnections(pids)
 	if err != nil {
-		if err == ebpf.ErrKeyNotExist {
-			return nil, nil
+		return nil, err
+	}
+	drops, err := nm.getDrops(pids)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[uint32]*types.NetworkStats, len(pids))
+	for _, pid := range pids {
+		var percpu []netmonNetworkStats
+		err := nm.maps.ProcessStats.Lookup(pid, &percpu)
+		if err != nil {
+			if err == ebpf.ErrKeyNotExist {
+				continue
+			}
+			return nil, fmt.Errorf("failed to lookup stats: %w", err)
+		}
+		stats := sumNetworkStats(percpu)
+
+		ifaces, err := nm.getInterfaceStats(pid)
+		if err != nil {
+			return nil, err
+		}
+
+		result := nm.networkStats(&stats)
+		if nm.histograms {
+			if result.Histograms, err = nm.getHistograms(pid); err != nil {
+				return nil, err
+			}
+		}
+		result.Interfaces = ifaces
+		result.Drops = drops[pid]
+		result.ActiveConns = conns[pid]
+		if result.ActiveConns == nil {
+			result.ActiveConns = make(map[string]types.ConnectionInfo)
+		}
+		result.SNI = serverNameTraffic(result.ActiveConns)
+		if nm.dns != nil {
+			result.DNS = nm.dns.get(pid)
+		}
+		if nm.http != nil {
+			result.HTTP = nm.http.get(pid)
+		}
+		results[pid] = &result
+	}
+	return results, nil
+}
+
+// AccountedPIDs returns the keys the kernel holds statistics for: monitored
+// processes, cgroup keys and, with AccountAll, every process with traffic
+func (nm *NetworkMonitor) AccountedPIDs() ([]uint32, error) {
+	var pids []uint32
+	var pid uint32
+	var percpu []netmonNetworkStats
+	iter := nm.maps.ProcessStats.Iterate()
+	for iter.Next(&pid, &percpu) {
+		pids = append(pids, pid)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate process statistics: %w", err)
+	}
+	return pids, nil
+}
+
+// AddPID enables in-kernel accounting for a process. With AttributeTree,
+// its running descendants are rolled up to it as well; the kernel adds
+// those forked later.
+func (nm *NetworkMonitor) AddPID(pid uint32) error {
+	if err := nm.maps.MonitoredPids.Put(pid, pid); err != nil {
+		return fmt.Errorf("failed to add PID %d to filter: %w", pid, err)
+	}
+	if nm.attribution != AttributeTree {
+		return nil
+	}
+
+	for _, child := range descendants("/proc", pid) {
+		// Descendants monitored in their own right keep their traffic
+		var root uint32
+		if err := nm.maps.MonitoredPids.Lookup(child, &root); err == nil && root == child {
+			continue
+		}
+		if err := nm.maps.MonitoredPids.Put(child, pid); err != nil {
+			return fmt.Errorf("failed to add descendant %d of PID %d to filter: %w", child, pid, err)
 		}
-		return nil, fmt.Errorf("failed to lookup stats: %w", err)
 	}
+	return nil
+}
+
+// RemovePID stops in-kernel accounting for a process and the descendants
+// rolled up to it
+func (nm *NetworkMonitor) RemovePID(pid uint32) error {
+	if err := nm.maps.MonitoredPids.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to remove PID %d from filter: %w", pid, err)
+	}
+
+	var stale []uint32
+	var child, root uint32
+	iter := nm.maps.MonitoredPids.Iterate()
+	for iter.Next(&child, &root) {
+		if root == pid {
+			stale = append(stale, child)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to iterate PID filter: %w", err)
+	}
+	for _, child := range stale {
+		nm.maps.MonitoredPids.Delete(child)
+	}
+	return nil
+}
 
-	return &types.NetworkStats{
+// AddCgroup enables in-kernel accounting for the processes of a cgroup v2
+// and its descendant cgroups, including ones that join later. Their traffic
+// is accounted under key, which must lie above the PID range; processes
+// monitored by PID keep their own traffic.
+func (nm *NetworkMonitor) AddCgroup(id uint64, key uint32) error {
+	if err := nm.maps.MonitoredCgroups.Put(id, key); err != nil {
+		return fmt.Errorf("failed to add cgroup %d to filter: %w", id, err)
+	}
+	return nil
+}
+
+// RemoveCgroup stops in-kernel accounting for a cgroup
+func (nm *NetworkMonitor) RemoveCgroup(id uint64) error {
+	if err := nm.maps.MonitoredCgroups.Delete(id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to remove cgroup %d from filter: %w", id, err)
+	}
+	return nil
+}
+
+// ClearProcessStats removes statistics for a specific PID
+func (nm *NetworkMonitor) ClearProcessStats(pid uint32) error {
+	if err := nm.clearDrops(pid); err != nil {
+		return err
+	}
+	if err := nm.clearInterfaceStats(pid); err != nil {
+		return err
+	}
+	if err := nm.clearConnections(pid); err != nil {
+		return err
+	}
+	if nm.dns != nil {
+		nm.dns.clear(pid)
+	}
+	if nm.http != nil {
+		nm.http.clear(pid)
+	}
+	if err := nm.clearHistograms(pid); err != nil {
+		return err
+	}
+	return nm.maps.ProcessStats.Delete(pid)
+}
+
+// networkStats converts kernel process counters to their user space form.
+// Without wire accounting, the totals are the socket-level counters.
+func (nm *NetworkMonitor) networkStats(stats *netmonNetworkStats) types.NetworkStats {
+	result := types.NetworkStats{
 		BytesIn:        stats.BytesIn,
 		BytesOut:       stats.BytesOut,
 		PacketsIn:      stats.PacketsIn,
 		PacketsOut:     stats.PacketsOut,
 		TCPConnections: stats.TcpConnections,
 		UDPConnections: stats.UdpConnections,
-		ActiveConns:    make(map[string]types.ConnectionInfo),
-	}, nil
+		TCPStates:      tcpStateCounts(stats.TcpStates),
+		IPv4:           trafficStats(&stats.Ipv4),
+		IPv6:           trafficStats(&stats.Ipv6),
+		Socket:         trafficStats(&stats.Socket),
+		Retransmits:    stats.Retransmits,
+		RSTIn:          stats.RstIn,
+		RSTOut:         stats.RstOut,
+	}
+	if stats.RttSamples > 0 {
+		result.SRTT = time.Duration(stats.SrttSumUs/stats.RttSamples) * time.Microsecond
+		result.RTTVar = time.Duration(stats.RttvarSumUs/stats.RttSamples) * time.Microsecond
+	}
+	if nm.accounting&AccountWire == 0 {
+		result.BytesIn = stats.Socket.BytesIn
+		result.BytesOut = stats.Socket.BytesOut
+		result.PacketsIn = stats.Socket.PacketsIn
+		result.PacketsOut = stats.Socket.PacketsOut
+	}
+	return result
 }
 
-// ClearProcessStats removes statistics for a specific PID
-func (nm *NetworkMonitor) ClearProcessStats(pid uint32) error {
-	return nm.maps.ProcessStats.Delete(pid)
+// sumNetworkStats adds up the per-CPU copies of a process's counters. TCP
+// state gauges may wrap on individual CPUs, so they are summed with uint32
+// wraparound to get the exact total.
+func sumNetworkStats(percpu []netmonNetworkStats) netmonNetworkStats {
+	var sum netmonNetworkStats
+	for i := range percpu {
+		s := &percpu[i]
+		sum.BytesIn += s.BytesIn
+		sum.BytesOut += s.BytesOut
+		sum.PacketsIn += s.PacketsIn
+		sum.PacketsOut += s.PacketsOut
+		addTrafficStats(&sum.Ipv4, &s.Ipv4)
+		addTrafficStats(&sum.Ipv6, &s.Ipv6)
+		addTrafficStats(&sum.Socket, &s.Socket)
+		sum.Retransmits += s.Retransmits
+		sum.RstIn += s.RstIn
+		sum.RstOut += s.RstOut
+		sum.SrttSumUs += s.SrttSumUs
+		sum.RttvarSumUs += s.RttvarSumUs
+		sum.RttSamples += s.RttSamples
+		sum.TcpConnections += s.TcpConnections
+		sum.UdpConnections += s.UdpConnections
+		for state := range s.TcpStates {
+			sum.TcpStates[state] += s.TcpStates[state]
+		}
+	}
+	return sum
+}
+
+// addTrafficStats adds the kernel traffic counters in src to dst
+func addTrafficStats(dst, src *netmonTrafficStats) {
+	dst.BytesIn += src.BytesIn
+	dst.BytesOut += src.BytesOut
+	dst.PacketsIn += src.PacketsIn
+	dst.PacketsOut += src.PacketsOut
+}
+
+// trafficStats converts kernel traffic counters to their user space form
+func trafficStats(stats *netmonTrafficStats) types.TrafficStats {
+	return types.TrafficStats{
+		BytesIn:    stats.BytesIn,
+		BytesOut:   stats.BytesOut,
+		PacketsIn:  stats.PacketsIn,
+		PacketsOut: stats.PacketsOut,
+	}
 }
@@ -0,0 +1,47 @@
+package bpf
+
+import "testing"
+
+func TestSumNetworkStats(t *testing.T) {
+	percpu := make([]netmonNetworkStats, 3)
+	percpu[0].PacketsOut = 5
+	percpu[0].BytesOut = 500
+	percpu[0].Ipv4.PacketsOut = 5
+	percpu[1].PacketsIn = 2
+	percpu[1].Ipv6.BytesIn = 80
+	percpu[1].Socket.BytesOut = 300
+	percpu[2].Socket.BytesOut = 100
+
+	// A connection established on one CPU and closed on another
+	percpu[0].TcpStates[1] = 1
+	percpu[0].TcpConnections = 2
+	percpu[2].TcpStates[1] = ^uint32(0)
+	percpu[2].TcpConnections = ^uint32(0)
+
+	sum := sumNetworkStats(percpu)
+	if sum.PacketsOut != 5 || sum.BytesOut != 500 || sum.PacketsIn != 2 {
+		t.Errorf("totals = %+v", sum)
+	}
+	if sum.Ipv4.PacketsOut != 5 || sum.Ipv6.BytesIn != 80 {
+		t.Errorf("family totals = %+v, %+v", sum.Ipv4, sum.Ipv6)
+	}
+	if sum.Socket.BytesOut != 400 {
+		t.Errorf("Socket.BytesOut = %d, want 400", sum.Socket.BytesOut)
+	}
+	if sum.TcpStates[1] != 0 {
+		t.Errorf("TcpStates[ESTABLISHED] = %d, want 0", sum.TcpStates[1])
+	}
+	if sum.TcpConnections != 1 {
+		t.Errorf("TcpConnections = %d, want 1", sum.TcpConnections)
+	}
+}
+
+func TestAcceptReturnArg(t *testing.T) {
+	arg, err := acceptReturnArg()
+	if err != nil {
+		t.Skipf("kernel BTF unavailable: %v", err)
+	}
+	if arg != 2 && arg != 4 {
+		t.Errorf("acceptReturnArg() = %d, want 2 or 4", arg)
+	}
+}
@@ -12,13 +12,139 @@ import (
 	"github.com/cilium/ebpf"
 )
 
+type netmonConnEvent struct {
+	Timestamp  uint64
+	Duration   uint64
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+	Pid        uint32
+	Type       uint8
+	Protocol   uint8
+	Family     uint16
+	Laddr      [16]uint8
+	Raddr      [16]uint8
+	Lport      uint16
+	Rport      uint16
+	Comm       [16]int8
+	_          [4]byte
+}
+
+type netmonConnKey struct {
+	Pid      uint32
+	Family   uint16
+	Protocol uint8
+	Pad      uint8
+	Laddr    [16]uint8
+	Raddr    [16]uint8
+	Lport    uint16
+	Rport    uint16
+}
+
+type netmonConnStats struct {
+	BytesIn      uint64
+	BytesOut     uint64
+	PacketsIn    uint64
+	PacketsOut   uint64
+	SockBytesIn  uint64
+	SockBytesOut uint64
+	FirstSeen    uint64
+	LastSeen     uint64
+	SrttUs       uint32
+	RttvarUs     uint32
+	Retransmits  uint32
+	Rsts         uint32
+	TcpFlags     uint8
+	State        uint8
+	PayloadSeen  uint8
+	_            [5]byte
+}
+
+type netmonDnsEvent struct {
+	Timestamp uint64
+	Pid       uint32
+	Len       uint16
+	Ingress   uint8
+	Protocol  uint8
+	Family    uint16
+	Lport     uint16
+	Rport     uint16
+	Pad       [2]uint8
+	Laddr     [16]uint8
+	Raddr     [16]uint8
+	Data      [512]uint8
+}
+
+type netmonDropKey struct {
+	Pid    uint32
+	Reason uint32
+}
+
+type netmonExitEvent struct {
+	Pid   uint32
+	Pad   uint32
+	Stats netmonNetworkStats
+}
+
+type netmonHistograms struct {
+	LastSeen [2]uint64
+	Size     [2][32]uint64
+	Gap      [2][32]uint64
+}
+
+type netmonHttpEvent struct {
+	Key       netmonConnKey
+	Len       uint16
+	Ingress   uint8
+	Pad       uint8
+	ConnBytes uint64
+	Data      [256]uint8
+}
+
+type netmonIfaceKey struct {
+	Pid     uint32
+	Ifindex uint32
+}
+
 type netmonNetworkStats struct {
 	BytesIn        uint64
 	BytesOut       uint64
 	PacketsIn      uint64
 	PacketsOut     uint64
+	Ipv4           netmonTrafficStats
+	Ipv6           netmonTrafficStats
+	Socket         netmonTrafficStats
+	Retransmits    uint64
+	RstIn          uint64
+	RstOut         uint64
+	SrttSumUs      uint64
+	RttvarSumUs    uint64
+	RttSamples     uint64
 	TcpConnections uint32
 	UdpConnections uint32
+	TcpStates      [16]uint32
+}
+
+type netmonSockOwner struct {
+	Tgid     uint32
+	State    uint8
+	Pad      [3]uint8
+	CgroupId uint64
+}
+
+type netmonTlsEvent struct {
+	Key  netmonConnKey
+	Len  uint16
+	Pad  [2]uint8
+	Data [2048]uint8
+}
+
+type netmonTrafficStats struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
 }
 
 // loadNetmon returns the embedded CollectionSpec for netmon.
@@ -63,22 +189,66 @@ type netmonSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type netmonProgramSpecs struct {
-	TcEgress  *ebpf.ProgramSpec `ebpf:"tc_egress"`
-	TcIngress *ebpf.ProgramSpec `ebpf:"tc_ingress"`
+	TcEgress              *ebpf.ProgramSpec `ebpf:"tc_egress"`
+	TcIngress             *ebpf.ProgramSpec `ebpf:"tc_ingress"`
+	TraceAccept           *ebpf.ProgramSpec `ebpf:"trace_accept"`
+	TraceExit             *ebpf.ProgramSpec `ebpf:"trace_exit"`
+	TraceFork             *ebpf.ProgramSpec `ebpf:"trace_fork"`
+	TraceInetSockSetState *ebpf.ProgramSpec `ebpf:"trace_inet_sock_set_state"`
+	TraceKfreeSkb         *ebpf.ProgramSpec `ebpf:"trace_kfree_skb"`
+	TraceSockCreate       *ebpf.ProgramSpec `ebpf:"trace_sock_create"`
+	TraceSockDestruct     *ebpf.ProgramSpec `ebpf:"trace_sock_destruct"`
+	TraceTcpConnect       *ebpf.ProgramSpec `ebpf:"trace_tcp_connect"`
+	TraceTcpRecvmsg       *ebpf.ProgramSpec `ebpf:"trace_tcp_recvmsg"`
+	TraceTcpRetransmit    *ebpf.ProgramSpec `ebpf:"trace_tcp_retransmit"`
+	TraceTcpSendmsg       *ebpf.ProgramSpec `ebpf:"trace_tcp_sendmsg"`
+	TraceUdpRecvmsg       *ebpf.ProgramSpec `ebpf:"trace_udp_recvmsg"`
+	TraceUdpSendmsg       *ebpf.ProgramSpec `ebpf:"trace_udp_sendmsg"`
+	TraceUdpv6Recvmsg     *ebpf.ProgramSpec `ebpf:"trace_udpv6_recvmsg"`
+	TraceUdpv6Sendmsg     *ebpf.ProgramSpec `ebpf:"trace_udpv6_sendmsg"`
 }
 
 // netmonMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type netmonMapSpecs struct {
-	InterfaceFilter *ebpf.MapSpec `ebpf:"interface_filter"`
-	ProcessStats    *ebpf.MapSpec `ebpf:"process_stats"`
+	ConnEvents       *ebpf.MapSpec `ebpf:"conn_events"`
+	Connections      *ebpf.MapSpec `ebpf:"connections"`
+	DnsEvents        *ebpf.MapSpec `ebpf:"dns_events"`
+	Drops            *ebpf.MapSpec `ebpf:"drops"`
+	ExitedPids       *ebpf.MapSpec `ebpf:"exited_pids"`
+	Exits            *ebpf.MapSpec `ebpf:"exits"`
+	Histograms       *ebpf.MapSpec `ebpf:"histograms"`
+	HttpEvents       *ebpf.MapSpec `ebpf:"http_events"`
+	IfaceStats       *ebpf.MapSpec `ebpf:"iface_stats"`
+	InterfaceFilter  *ebpf.MapSpec `ebpf:"interface_filter"`
+	MonitoredCgroups *ebpf.MapSpec `ebpf:"monitored_cgroups"`
+	MonitoredPids    *ebpf.MapSpec `ebpf:"monitored_pids"`
+	ProcessStats     *ebpf.MapSpec `ebpf:"process_stats"`
+	SockOwners       *ebpf.MapSpec `ebpf:"sock_owners"`
+	TlsEvents        *ebpf.MapSpec `ebpf:"tls_events"`
 }
 
 // netmonVariableSpecs contains global variables before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type netmonVariableSpecs struct {
+	AcceptRetArg     *ebpf.VariableSpec `ebpf:"accept_ret_arg"`
+	AccountAll       *ebpf.VariableSpec `ebpf:"account_all"`
+	CaptureDns       *ebpf.VariableSpec `ebpf:"capture_dns"`
+	CaptureHttp      *ebpf.VariableSpec `ebpf:"capture_http"`
+	CaptureTls       *ebpf.VariableSpec `ebpf:"capture_tls"`
+	Decapsulate      *ebpf.VariableSpec `ebpf:"decapsulate"`
+	EmitEvents       *ebpf.VariableSpec `ebpf:"emit_events"`
+	NrCpus           *ebpf.VariableSpec `ebpf:"nr_cpus"`
+	TrackCgroups     *ebpf.VariableSpec `ebpf:"track_cgroups"`
+	TrackDescendants *ebpf.VariableSpec `ebpf:"track_descendants"`
+	TrackHistograms  *ebpf.VariableSpec `ebpf:"track_histograms"`
+	UnusedConnEvent  *ebpf.VariableSpec `ebpf:"unused_conn_event"`
+	UnusedDnsEvent   *ebpf.VariableSpec `ebpf:"unused_dns_event"`
+	UnusedExitEvent  *ebpf.VariableSpec `ebpf:"unused_exit_event"`
+	UnusedHttpEvent  *ebpf.VariableSpec `ebpf:"unused_http_event"`
+	UnusedTlsEvent   *ebpf.VariableSpec `ebpf:"unused_tls_event"`
 }
 
 // netmonObjects contains all objects after they have been loaded into the kernel.
@@ -101,14 +271,40 @@ func (o *netmonObjects) Close() error {
 //
 // It can be passed to loadNetmonObjects or ebpf.CollectionSpec.LoadAndAssign.
 type netmonMaps struct {
-	InterfaceFilter *ebpf.Map `ebpf:"interface_filter"`
-	ProcessStats    *ebpf.Map `ebpf:"process_stats"`
+	ConnEvents       *ebpf.Map `ebpf:"conn_events"`
+	Connections      *ebpf.Map `ebpf:"connections"`
+	DnsEvents        *ebpf.Map `ebpf:"dns_events"`
+	Drops            *ebpf.Map `ebpf:"drops"`
+	ExitedPids       *ebpf.Map `ebpf:"exited_pids"`
+	Exits            *ebpf.Map `ebpf:"exits"`
+	Histograms       *ebpf.Map `ebpf:"histograms"`
+	HttpEvents       *ebpf.Map `ebpf:"http_events"`
+	IfaceStats       *ebpf.Map `ebpf:"iface_stats"`
+	InterfaceFilter  *ebpf.Map `ebpf:"interface_filter"`
+	MonitoredCgroups *ebpf.Map `ebpf:"monitored_cgroups"`
+	MonitoredPids    *ebpf.Map `ebpf:"monitored_pids"`
+	ProcessStats     *ebpf.Map `ebpf:"process_stats"`
+	SockOwners       *ebpf.Map `ebpf:"sock_owners"`
+	TlsEvents        *ebpf.Map `ebpf:"tls_events"`
 }
 
 func (m *netmonMaps) Close() error {
 	return _NetmonClose(
+		m.ConnEvents,
+		m.Connections,
+		m.DnsEvents,
+		m.Drops,
+		m.ExitedPids,
+		m.Exits,
+		m.Histograms,
+		m.HttpEvents,
+		m.IfaceStats,
 		m.InterfaceFilter,
+		m.MonitoredCgroups,
+		m.MonitoredPids,
 		m.ProcessStats,
+		m.SockOwners,
+		m.TlsEvents,
 	)
 }
 
@@ -116,20 +312,66 @@ func (m *netmonMaps) Close() error {
 //
 // It can be passed to loadNetmonObjects or ebpf.CollectionSpec.LoadAndAssign.
 type netmonVariables struct {
+	AcceptRetArg     *ebpf.Variable `ebpf:"accept_ret_arg"`
+	AccountAll       *ebpf.Variable `ebpf:"account_all"`
+	CaptureDns       *ebpf.Variable `ebpf:"capture_dns"`
+	CaptureHttp      *ebpf.Variable `ebpf:"capture_http"`
+	CaptureTls       *ebpf.Variable `ebpf:"capture_tls"`
+	Decapsulate      *ebpf.Variable `ebpf:"decapsulate"`
+	EmitEvents       *ebpf.Variable `ebpf:"emit_events"`
+	NrCpus           *ebpf.Variable `ebpf:"nr_cpus"`
+	TrackCgroups     *ebpf.Variable `ebpf:"track_cgroups"`
+	TrackDescendants *ebpf.Variable `ebpf:"track_descendants"`
+	TrackHistograms  *ebpf.Variable `ebpf:"track_histograms"`
+	UnusedConnEvent  *ebpf.Variable `ebpf:"unused_conn_event"`
+	UnusedDnsEvent   *ebpf.Variable `ebpf:"unused_dns_event"`
+	UnusedExitEvent  *ebpf.Variable `ebpf:"unused_exit_event"`
+	UnusedHttpEvent  *ebpf.Variable `ebpf:"unused_http_event"`
+	UnusedTlsEvent   *ebpf.Variable `ebpf:"unused_tls_event"`
 }
 
 // netmonPrograms contains all programs after they have been loaded into the kernel.
 //
 // It can be passed to loadNetmonObjects or ebpf.CollectionSpec.LoadAndAssign.
 type netmonPrograms struct {
-	TcEgress  *ebpf.Program `ebpf:"tc_egress"`
-	TcIngress *ebpf.Program `ebpf:"tc_ingress"`
+	TcEgress              *ebpf.Program `ebpf:"tc_egress"`
+	TcIngress             *ebpf.Program `ebpf:"tc_ingress"`
+	TraceAccept           *ebpf.Program `ebpf:"trace_accept"`
+	TraceExit             *ebpf.Program `ebpf:"trace_exit"`
+	TraceFork             *ebpf.Program `ebpf:"trace_fork"`
+	TraceInetSockSetState *ebpf.Program `ebpf:"trace_inet_sock_set_state"`
+	TraceKfreeSkb         *ebpf.Program `ebpf:"trace_kfree_skb"`
+	TraceSockCreate       *ebpf.Program `ebpf:"trace_sock_create"`
+	TraceSockDestruct     *ebpf.Program `ebpf:"trace_sock_destruct"`
+	TraceTcpConnect       *ebpf.Program `ebpf:"trace_tcp_connect"`
+	TraceTcpRecvmsg       *ebpf.Program `ebpf:"trace_tcp_recvmsg"`
+	TraceTcpRetransmit    *ebpf.Program `ebpf:"trace_tcp_retransmit"`
+	TraceTcpSendmsg       *ebpf.Program `ebpf:"trace_tcp_sendmsg"`
+	TraceUdpRecvmsg       *ebpf.Program `ebpf:"trace_udp_recvmsg"`
+	TraceUdpSendmsg       *ebpf.Program `ebpf:"trace_udp_sendmsg"`
+	TraceUdpv6Recvmsg     *ebpf.Program `ebpf:"trace_udpv6_recvmsg"`
+	TraceUdpv6Sendmsg     *ebpf.Program `ebpf:"trace_udpv6_sendmsg"`
 }
 
 func (p *netmonPrograms) Close() error {
 	return _NetmonClose(
 		p.TcEgress,
 		p.TcIngress,
+		p.TraceAccept,
+		p.TraceExit,
+		p.TraceFork,
+		p.TraceInetSockSetState,
+		p.TraceKfreeSkb,
+		p.TraceSockCreate,
+		p.TraceSockDestruct,
+		p.TraceTcpConnect,
+		p.TraceTcpRecvmsg,
+		p.TraceTcpRetransmit,
+		p.TraceTcpSendmsg,
+		p.TraceUdpRecvmsg,
+		p.TraceUdpSendmsg,
+		p.TraceUdpv6Recvmsg,
+		p.TraceUdpv6Sendmsg,
 	)
 }
 
@@ -0,0 +1,61 @@
+package bpf
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// descendants returns the PIDs of all running descendants of pid, at any
+// depth, from the parent PIDs recorded in procfs
+func descendants(procRoot string, pid uint32) []uint32 {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[uint32][]uint32)
+	for _, entry := range entries {
+		child, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		ppid, err := readPPID(filepath.Join(procRoot, entry.Name(), "stat"))
+		if err != nil {
+			continue // Process exited meanwhile
+		}
+		children[ppid] = append(children[ppid], uint32(child))
+	}
+
+	var result []uint32
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		result = append(result, next)
+		queue = append(queue, children[next]...)
+	}
+	return result
+}
+
+// readPPID reads the parent PID from a /proc/[pid]/stat file
+func readPPID(path string) (uint32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name may contain spaces and parentheses; the fields
+	// after its closing parenthesis are the state and the parent PID
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 2 {
+		return 0, os.ErrInvalid
+	}
+	ppid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(ppid), nil
+}
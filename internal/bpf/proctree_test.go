@@ -0,0 +1,39 @@
+package bpf
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDescendants(t *testing.T) {
+	root := t.TempDir()
+	for pid, stat := range map[string]string{
+		"1":   "1 (init) S 0 1 1 0",
+		"100": "100 (sh) S 1 100 100 0",
+		"101": "101 (make) S 100 100 100 0",
+		"102": "102 (cc (x) y) R 101 100 100 0",
+		"200": "200 (other) S 1 200 200 0",
+	} {
+		dir := filepath.Join(root, pid)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "self"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got := descendants(root, 100)
+	slices.Sort(got)
+	if want := []uint32{101, 102}; !slices.Equal(got, want) {
+		t.Errorf("descendants(100) = %v, want %v", got, want)
+	}
+	if got := descendants(root, 200); len(got) != 0 {
+		t.Errorf("descendants(200) = %v, want none", got)
+	}
+}
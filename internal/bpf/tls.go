@@ -0,0 +1,166 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// TLS message and extension numbers (RFC 8446, RFC 6066)
+const (
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 0x01
+	tlsExtServerName   = 0x0000
+	tlsServerNameHost  = 0x00
+)
+
+var errTLSTruncated = errors.New("truncated TLS ClientHello")
+
+// tlsReader reads length-prefixed fields of a TLS message
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+// next returns the following n bytes
+func (r *tlsReader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errTLSTruncated
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint returns the following n byte big endian integer
+func (r *tlsReader) uint(n int) int {
+	var v int
+	for _, b := range r.next(n) {
+		v = v<<8 | int(b)
+	}
+	return v
+}
+
+// vector returns the contents of a vector with an n byte length prefix
+func (r *tlsReader) vector(n int) []byte {
+	return r.next(r.uint(n))
+}
+
+// parseClientHello returns the server name (SNI) requested in the start of
+// a TLS ClientHello record, or "" if it carries none. The ClientHello may be
+// cut short as long as the server name extension is complete.
+func parseClientHello(data []byte) (string, error) {
+	r := &tlsReader{data: data}
+
+	// Record header
+	if r.uint(1) != tlsRecordHandshake {
+		return "", errors.New("not a TLS handshake record")
+	}
+	r.next(4) // Version, length
+
+	// Handshake header
+	if r.uint(1) != tlsClientHello {
+		return "", errors.New("not a TLS ClientHello")
+	}
+	r.next(3)   // Length
+	r.next(2)   // Client version
+	r.next(32)  // Random
+	r.vector(1) // Session ID
+	r.vector(2) // Cipher suites
+	r.vector(1) // Compression methods
+	if r.err != nil {
+		return "", r.err
+	}
+	if len(r.data) == 0 {
+		return "", nil // No extensions
+	}
+
+	// Extensions, which may run past the captured bytes
+	extLen := r.uint(2)
+	if r.err != nil {
+		return "", r.err
+	}
+	exts := &tlsReader{data: r.data[:min(len(r.data), extLen)]}
+	for len(exts.data) > 0 {
+		typ := exts.uint(2)
+		body := exts.vector(2)
+		if exts.err != nil {
+			return "", exts.err
+		}
+		if typ != tlsExtServerName {
+			continue
+		}
+
+		names := &tlsReader{data: body}
+		list := &tlsReader{data: names.vector(2)}
+		for len(list.data) > 0 && list.err == nil {
+			nameType := list.uint(1)
+			name := list.vector(2)
+			if list.err == nil && nameType == tlsServerNameHost {
+				return string(name), nil
+			}
+		}
+		if names.err != nil {
+			return "", names.err
+		}
+		return "", list.err
+	}
+	return "", nil
+}
+
+// readTLS starts recording the server names of outgoing TLS connections
+// from the kernel ring buffer
+func (nm *NetworkMonitor) readTLS() error {
+	err := nm.readRing(nm.maps.TlsEvents, func(raw []byte) bool {
+		var event netmonTlsEvent
+		if err := binary.Read(bytes.NewReader(raw), binary.NativeEndian, &event); err != nil {
+			return true
+		}
+		name, err := parseClientHello(event.Data[:min(int(event.Len), len(event.Data))])
+		if err != nil || name == "" {
+			return true
+		}
+
+		nm.sniMu.Lock()
+		nm.sni[event.Key] = name
+		nm.sniMu.Unlock()
+		return true
+	}, func() {})
+	if err != nil {
+		return fmt.Errorf("failed to open TLS ring buffer: %w", err)
+	}
+	return nil
+}
+
+// serverName returns the TLS server name recorded for a connection
+func (nm *NetworkMonitor) serverName(key *netmonConnKey) string {
+	nm.sniMu.Lock()
+	defer nm.sniMu.Unlock()
+	return nm.sni[*key]
+}
+
+// forgetServerNames drops the server names of connections that are no
+// longer tracked by the kernel, once there are more than it can track
+func (nm *NetworkMonitor) forgetServerNames(expired []netmonConnKey) {
+	nm.sniMu.Lock()
+	defer nm.sniMu.Unlock()
+
+	for _, key := range expired {
+		delete(nm.sni, key)
+	}
+
+	// Connections evicted from the LRU map are never seen expiring
+	if len(nm.sni) <= int(nm.maps.Connections.MaxEntries()) {
+		return
+	}
+	var val netmonConnStats
+	for key := range nm.sni {
+		if err := nm.maps.Connections.Lookup(&key, &val); errors.Is(err, ebpf.ErrKeyNotExist) {
+			delete(nm.sni, key)
+		}
+	}
+}
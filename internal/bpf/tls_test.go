@@ -0,0 +1,86 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// clientHello builds a TLS ClientHello record with the given extensions
+func clientHello(exts ...[]byte) []byte {
+	var body []byte
+	body = append(body, 0x03, 0x03)          // Client version
+	body = append(body, make([]byte, 32)...) // Random
+	body = append(body, 0)                   // Session ID
+	body = append(body, 0, 2, 0x13, 0x01)    // Cipher suites
+	body = append(body, 1, 0)                // Compression methods
+	var all []byte
+	for _, ext := range exts {
+		all = append(all, ext...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(all)))
+	body = append(body, all...)
+
+	msg := []byte{tlsClientHello, 0, byte(len(body) >> 8), byte(len(body))}
+	msg = append(msg, body...)
+
+	record := []byte{tlsRecordHandshake, 0x03, 0x01}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(msg)))
+	return append(record, msg...)
+}
+
+// tlsExtension builds a TLS extension
+func tlsExtension(typ uint16, body []byte) []byte {
+	ext := binary.BigEndian.AppendUint16(nil, typ)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(body)))
+	return append(ext, body...)
+}
+
+// serverNameExt builds a server name extension for host
+func serverNameExt(host string) []byte {
+	entry := append([]byte{tlsServerNameHost}, byte(len(host)>>8), byte(len(host)))
+	entry = append(entry, host...)
+	list := binary.BigEndian.AppendUint16(nil, uint16(len(entry)))
+	return tlsExtension(tlsExtServerName, append(list, entry...))
+}
+
+func TestParseClientHello(t *testing.T) {
+	// Server name after another extension
+	hello := clientHello(tlsExtension(0x002b, []byte{2, 0x03, 0x04}), serverNameExt("api.example.com"))
+	name, err := parseClientHello(hello)
+	if err != nil || name != "api.example.com" {
+		t.Errorf("parseClientHello = %q, %v; want api.example.com", name, err)
+	}
+
+	// Capture cut short after the server name
+	hello = clientHello(serverNameExt("api.example.com"), tlsExtension(0x0033, make([]byte, 1200)))
+	name, err = parseClientHello(hello[:100])
+	if err != nil || name != "api.example.com" {
+		t.Errorf("parseClientHello on truncated capture = %q, %v; want api.example.com", name, err)
+	}
+
+	name, err = parseClientHello(clientHello(tlsExtension(0x002b, []byte{2, 0x03, 0x04})))
+	if err != nil || name != "" {
+		t.Errorf("parseClientHello without SNI = %q, %v; want none", name, err)
+	}
+
+	if _, err := parseClientHello([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Error("Expected error for non-TLS payload")
+	}
+}
+
+func TestServerNameTraffic(t *testing.T) {
+	conns := map[string]types.ConnectionInfo{
+		"a": {SNI: "api.example.com", BytesIn: 1000, BytesOut: 100},
+		"b": {SNI: "api.example.com", BytesIn: 500},
+		"c": {BytesIn: 9999},
+	}
+	traffic := serverNameTraffic(conns)
+	if len(traffic) != 1 {
+		t.Fatalf("Expected 1 server name, got %v", traffic)
+	}
+	if got := traffic["api.example.com"]; got.BytesIn != 1500 || got.BytesOut != 100 {
+		t.Errorf("api.example.com traffic = %+v, want 1500/100", got)
+	}
+}
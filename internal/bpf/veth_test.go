@@ -0,0 +1,253 @@
+package bpf
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	benchVeth = "pnm-bench0"
+	benchPeer = "pnm-bench1"
+)
+
+var (
+	benchLocalIP = net.IPv4(10, 213, 0, 1)
+	benchPeerIP  = net.IPv4(10, 213, 0, 2)
+)
+
+// BenchmarkVethAccuracy sends UDP from all CPUs through a veth pair and
+// compares the bytes counted by the process's per-CPU counters, and by a
+// counter shared between CPUs, with the bytes the veth transmitted. Shared
+// counters lose concurrent increments at high packet rates; the per-CPU
+// ones must not lose any. Requires root.
+func BenchmarkVethAccuracy(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("requires root")
+	}
+	setupVeth(b)
+
+	nm, err := New(Config{Interfaces: []string{benchVeth}})
+	if err != nil {
+		b.Fatalf("failed to load monitor: %v", err)
+	}
+	defer nm.Stop()
+	if err := nm.Start(); err != nil {
+		b.Fatal(err)
+	}
+
+	pid := uint32(os.Getpid())
+	if err := nm.AddPID(pid); err != nil {
+		b.Fatal(err)
+	}
+	shared := attachSharedCounter(b, benchVeth)
+	txBefore := txBytes(b, benchVeth)
+
+	// Unconnected sockets, so ICMP errors from the peer do not fail writes
+	dst := &net.UDPAddr{IP: benchPeerIP, Port: 9}
+	payload := make([]byte, 64)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: benchLocalIP})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		for pb.Next() {
+			conn.WriteToUDP(payload, dst)
+		}
+	})
+	b.StopTimer()
+
+	sent := txBytes(b, benchVeth) - txBefore
+	if sent == 0 {
+		b.Fatal("no bytes sent over the veth pair")
+	}
+
+	stats, err := nm.GetProcessStats(pid)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var perCPU uint64
+	if stats != nil {
+		perCPU = stats.BytesOut
+	}
+
+	perCPUErr := (float64(sent) - float64(perCPU)) / float64(sent)
+	sharedErr := (float64(sent) - float64(shared())) / float64(sent)
+	b.ReportMetric(100*perCPUErr, "percpu-err-%")
+	b.ReportMetric(100*sharedErr, "shared-err-%")
+	if perCPU != sent {
+		b.Errorf("per-CPU counters have %d bytes out, veth sent %d (%.3f%% off)", perCPU, sent, 100*perCPUErr)
+	}
+}
+
+// attachSharedCounter attaches a TC egress program to an interface that adds
+// up packet bytes in a single counter shared by all CPUs, with the plain
+// read-modify-write that process_stats used before it became per-CPU. The
+// returned function reads the counter.
+func attachSharedCounter(b *testing.B, ifname string) func() uint64 {
+	b.Helper()
+
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	counter, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { counter.Close() })
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:    ebpf.SchedCLS,
+		License: "GPL",
+		Instructions: asm.Instructions{
+			asm.Mov.Reg(asm.R6, asm.R1),
+			asm.StoreImm(asm.RFP, -4, 0, asm.Word),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, -4),
+			asm.LoadMapPtr(asm.R1, counter.FD()),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, "next"),
+			asm.LoadMem(asm.R1, asm.R6, 0, asm.Word), // skb->len
+			asm.LoadMem(asm.R2, asm.R0, 0, asm.DWord),
+			asm.Add.Reg(asm.R2, asm.R1),
+			asm.StoreMem(asm.R0, 0, asm.R2, asm.DWord),
+			asm.Mov.Imm(asm.R0, -1).WithSymbol("next"), // TCX_NEXT
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		b.Fatalf("failed to load shared counter: %v", err)
+	}
+	b.Cleanup(func() { prog.Close() })
+
+	l, err := link.AttachTCX(link.TCXOptions{
+		Interface: iface.Index,
+		Program:   prog,
+		Attach:    ebpf.AttachTCXEgress,
+	})
+	if err != nil {
+		b.Fatalf("failed to attach shared counter: %v", err)
+	}
+	b.Cleanup(func() { l.Close() })
+
+	return func() uint64 {
+		var total uint64
+		if err := counter.Lookup(uint32(0), &total); err != nil {
+			b.Fatal(err)
+		}
+		return total
+	}
+}
+
+// txBytes returns the bytes an interface has transmitted
+func txBytes(b *testing.B, ifname string) uint64 {
+	b.Helper()
+	l, err := netlink.LinkByName(ifname)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return l.Attrs().Statistics.TxBytes
+}
+
+// setupVeth creates a veth pair with its peer end in a new network
+// namespace, so that traffic to the peer address leaves through the pair
+func setupVeth(b *testing.B) {
+	b.Helper()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer origin.Close()
+
+	peerNS, err := netns.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { peerNS.Close() })
+	if err := netns.Set(origin); err != nil {
+		b.Fatal(err)
+	}
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: benchVeth},
+		PeerName:  benchPeer,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		b.Fatalf("failed to create veth pair: %v", err)
+	}
+	b.Cleanup(func() { netlink.LinkDel(veth) })
+
+	host, err := netlink.LinkByName(benchVeth)
+	if err != nil {
+		b.Fatal(err)
+	}
+	peer, err := netlink.LinkByName(benchPeer)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(peerNS)); err != nil {
+		b.Fatal(err)
+	}
+
+	h, err := netlink.NewHandleAt(peerNS)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Delete()
+
+	peer, err = h.LinkByName(benchPeer)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	mask := net.CIDRMask(30, 32)
+	if err := netlink.AddrAdd(host, &netlink.Addr{IPNet: &net.IPNet{IP: benchLocalIP, Mask: mask}}); err != nil {
+		b.Fatal(err)
+	}
+	if err := h.AddrAdd(peer, &netlink.Addr{IPNet: &net.IPNet{IP: benchPeerIP, Mask: mask}}); err != nil {
+		b.Fatal(err)
+	}
+	// Only the benchmark's packets may leave through the pair, not IPv6
+	// router solicitations and the like
+	os.WriteFile("/proc/sys/net/ipv6/conf/"+benchVeth+"/disable_ipv6", []byte("1"), 0o644)
+	if err := netlink.LinkSetUp(host); err != nil {
+		b.Fatal(err)
+	}
+	if err := h.LinkSetUp(peer); err != nil {
+		b.Fatal(err)
+	}
+
+	// Packets queued on neighbour resolution never reach TC
+	neigh := &netlink.Neigh{
+		LinkIndex:    host.Attrs().Index,
+		State:        netlink.NUD_PERMANENT,
+		IP:           benchPeerIP,
+		HardwareAddr: peer.Attrs().HardwareAddr,
+	}
+	if err := netlink.NeighAdd(neigh); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -27,6 +27,7 @@ type Config struct {
 	SampleInterval time.Duration
 	WindowSize     int  // Number of samples to keep for rate calculation
 	Continuous     bool // Whether to collect continuously
+	AccountAll     bool // Show every process the kernel accounts, see bpf.Config
 }
 
 // sample represents a single statistics sample
@@ -57,6 +58,7 @@ func New(bpfMon *bpf.NetworkMonitor, procMon *process.Monitor, cfg Config) *Coll
 func (c *Collector) Start() error {
 	// Start collection goroutine
 	go c.collect()
+	go c.collectExits()
 	return nil
 }
 
@@ -80,20 +82,54 @@ func (c *Collector) collect() {
 	}
 }
 
+// collectExits hands the final statistics of exited processes to the
+// process monitor
+func (c *Collector) collectExits() {
+	exits := c.bpfMonitor.Exits()
+	for {
+		select {
+		case exit, ok := <-exits:
+			if !ok {
+				return
+			}
+			pid := int32(exit.PID)
+			c.procMon.Exit(pid, exit.Stats)
+
+			c.mu.Lock()
+			delete(c.samples, pid)
+			c.mu.Unlock()
+		case <-c.stopped:
+			return
+		}
+	}
+}
+
 // updateStats fetches current statistics and updates rates
 func (c *Collector) updateStats() {
+	if c.config.AccountAll {
+		c.observeAccounted()
+	}
 	pids := c.procMon.GetMonitoredPIDs()
 
+	// Get current stats from eBPF, in one pass over the kernel maps
+	keys := make([]uint32, len(pids))
+	for i, pid := range pids {
+		keys[i] = uint32(pid)
+	}
+	all, err := c.bpfMonitor.GetStatsForPIDs(keys)
+	if err != nil {
+		return
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	now := time.Now()
 
 	for _, pid := range pids {
-		// Get current stats from eBPF
-		stats, err := c.bpfMonitor.GetProcessStats(uint32(pid))
-		if err != nil {
-			continue // Skip this process if we can't get stats
+		stats := all[uint32(pid)]
+		if stats == nil {
+			continue // Skip this process if we have no stats
 		}
 
 		// Get or initialize sample slice
@@ -131,6 +167,25 @@ func (c *Collector) updateStats() {
 	}
 }
 
+// observeAccounted shows the processes the kernel has accounted on its own
+// in the process monitor
+func (c *Collector) observeAccounted() {
+	accounted, err := c.bpfMonitor.AccountedPIDs()
+	if err != nil {
+		return
+	}
+
+	known := make(map[int32]bool)
+	for _, pid := range c.procMon.GetMonitoredPIDs() {
+		known[pid] = true
+	}
+	for _, pid := range accounted {
+		if !known[int32(pid)] {
+			c.procMon.Observe(int32(pid)) // Cgroup keys and exited processes fail
+		}
+	}
+}
+
 // GetRates returns current transfer rates for a process
 func (c *Collector) GetRates(pid int32) (in float64, out float64, err error) {
 	c.mu.RLock()
@@ -159,23 +214,17 @@ func (c *Collector) GetAggregatedStats() *types.NetworkStats {
 	defer c.mu.RUnlock()
 
 	aggregated := &types.NetworkStats{
+		TCPStates:   make(map[string]uint32),
+		Interfaces:  make(map[string]types.TrafficStats),
+		Drops:       make(map[string]uint64),
+		SNI:         make(map[string]types.TrafficStats),
 		ActiveConns: make(map[string]types.ConnectionInfo),
 	}
 
 	for pid := range c.samples {
 		if stats, err := c.procMon.GetProcessStats(pid); err == nil {
 			current, _, _ := stats.GetStats()
-			aggregated.BytesIn += current.BytesIn
-			aggregated.BytesOut += current.BytesOut
-			aggregated.PacketsIn += current.PacketsIn
-			aggregated.PacketsOut += current.PacketsOut
-			aggregated.TCPConnections += current.TCPConnections
-			aggregated.UDPConnections += current.UDPConnections
-
-			// Merge connection maps
-			for k, v := range current.ActiveConns {
-				aggregated.ActiveConns[k] = v
-			}
+			aggregated.Add(current)
 		}
 	}
 
@@ -0,0 +1,91 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clientTimeout bounds each request to the runtime
+const clientTimeout = 2 * time.Second
+
+// ErrNotFound is returned for containers the runtime does not know
+var ErrNotFound = errors.New("container not found")
+
+// Client talks to the Docker Engine API of a container runtime over its
+// local socket. Podman serves the same API.
+type Client struct {
+	http *http.Client
+}
+
+// Details holds what the runtime reports about a container
+type Details struct {
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+}
+
+// inspectResponse is the subset of the container inspect response we use
+type inspectResponse struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Pid int `json:"Pid"`
+	} `json:"State"`
+}
+
+// NewClient creates a client for the runtime listening on socket
+func NewClient(socket string) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout: clientTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Inspect returns the details of a container given by name, ID or ID
+// prefix, and the PID of its main process, 0 if it is not running
+func (c *Client) Inspect(ref string) (*Details, int, error) {
+	// The host is ignored when dialing the socket
+	resp, err := c.http.Get("http://runtime/containers/" + url.PathEscape(ref) + "/json")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to ask container runtime: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, 0, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	default:
+		return nil, 0, fmt.Errorf("container runtime returned %s for %s", resp.Status, ref)
+	}
+
+	var inspect inspectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode container %s: %w", ref, err)
+	}
+	return &Details{
+		ID:     inspect.ID,
+		Name:   strings.TrimPrefix(inspect.Name, "/"),
+		Image:  inspect.Config.Image,
+		Labels: inspect.Config.Labels,
+	}, inspect.State.Pid, nil
+}
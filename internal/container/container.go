@@ -0,0 +1,276 @@
+// Package container finds the containers and Kubernetes pods processes run
+// in, from their cgroups and the container runtime
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// scopePattern matches the cgroup of a container as named by its runtime:
+// docker-<id>.scope, cri-containerd-<id>.scope, crio-<id>.scope and
+// libpod-<id>.scope with the systemd cgroup driver, or the bare ID with the
+// cgroupfs driver
+var scopePattern = regexp.MustCompile(`^(?:(docker|cri-containerd|crio|libpod)-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+// podPattern matches the cgroup of a Kubernetes pod: kubepods-<qos>-pod<uid>.slice
+// with the systemd cgroup driver, where the dashes of the UID are replaced by
+// underscores, or pod<uid> with the cgroupfs driver
+var podPattern = regexp.MustCompile(`^(?:kubepods(?:-[a-z]+)?-)?pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(?:\.slice)?$`)
+
+// runtimes maps the cgroup name prefixes of runtimes to their names
+var runtimes = map[string]string{
+	"docker":         "docker",
+	"cri-containerd": "containerd",
+	"crio":           "cri-o",
+	"libpod":         "podman",
+}
+
+// cgroupMatch is a container found in a cgroup path
+type cgroupMatch struct {
+	id      string
+	runtime string
+	cgroup  string // Cgroup of the container, a prefix of the path
+	podUID  string // UID of the Kubernetes pod of the container, if any
+}
+
+// parseCgroupPath finds the container a cgroup v2 path belongs to. The
+// innermost container wins, e.g. for nested containers.
+func parseCgroupPath(path string) (cgroupMatch, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		m := scopePattern.FindStringSubmatch(segments[i])
+		if m == nil {
+			continue
+		}
+		runtime := runtimes[m[1]]
+		// cgroupfs driver: /docker/<id>
+		if m[1] == "" && i > 0 && segments[i-1] == "docker" {
+			runtime = "docker"
+		}
+		return cgroupMatch{
+			id:      m[2],
+			runtime: runtime,
+			cgroup:  "/" + strings.Join(segments[:i+1], "/"),
+			podUID:  findPodUID(segments[:i]),
+		}, true
+	}
+	return cgroupMatch{}, false
+}
+
+// findPodUID finds the UID of the Kubernetes pod among the cgroups a
+// container is nested in
+func findPodUID(segments []string) string {
+	for i := len(segments) - 1; i >= 0; i-- {
+		if m := podPattern.FindStringSubmatch(segments[i]); m != nil {
+			return strings.ReplaceAll(m[1], "_", "-")
+		}
+	}
+	return ""
+}
+
+// readCgroup reads the cgroup v2 path of a process from /proc/<pid>/cgroup
+func readCgroup(procRoot string, pid int32) (string, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.FormatInt(int64(pid), 10), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+
+	// Unified hierarchy entries have ID 0 and no controllers
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("process %d is not in a cgroup v2", pid)
+}
+
+// Resolver finds the containers and pods processes run in and asks the
+// container runtime for their details, which are cached
+type Resolver struct {
+	procRoot string
+	client   *Client    // Nil to rely on cgroup names only
+	cri      *CRIClient // Nil to know pods by UID only
+
+	mu    sync.Mutex
+	cache map[string]*types.ContainerInfo // By container ID
+	pods  map[string]*types.PodInfo       // By pod UID
+}
+
+// NewResolver creates a resolver asking the Docker Engine API compatible
+// runtime at socket, e.g. Docker or Podman, about containers, and the CRI
+// runtime at criSocket, e.g. containerd or CRI-O, about Kubernetes pods and
+// their containers. Without sockets, only container IDs, runtimes and pod
+// UIDs are found.
+func NewResolver(socket, criSocket string) *Resolver {
+	r := &Resolver{
+		procRoot: "/proc",
+		cache:    make(map[string]*types.ContainerInfo),
+		pods:     make(map[string]*types.PodInfo),
+	}
+	if socket != "" {
+		r.client = NewClient(socket)
+	}
+	if criSocket != "" {
+		r.cri = NewCRIClient(criSocket)
+	}
+	return r
+}
+
+// Container returns the container process pid runs in, or nil if it runs on
+// the host or has exited
+func (r *Resolver) Container(pid int32) *types.ContainerInfo {
+	path, err := readCgroup(r.procRoot, pid)
+	if err != nil {
+		return nil
+	}
+	m, ok := parseCgroupPath(path)
+	if !ok {
+		return nil
+	}
+	return r.info(m)
+}
+
+// info returns the details of a container found in a cgroup path, asking
+// the runtimes once per container and pod. Details are not cached while a
+// runtime cannot be reached, so that they are filled in once it can.
+func (r *Resolver) info(m cgroupMatch) *types.ContainerInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if info, ok := r.cache[m.id]; ok {
+		return info
+	}
+	info := &types.ContainerInfo{ID: m.id, Runtime: m.runtime}
+	complete := true
+	if r.client != nil {
+		details, _, err := r.client.Inspect(m.id)
+		if err == nil {
+			info.Name = details.Name
+			info.Image = details.Image
+			info.Labels = details.Labels
+		}
+		complete = answered(err)
+	}
+	if m.podUID != "" {
+		// Pod containers are named within their pod
+		if r.cri != nil && info.Name == "" {
+			details, err := r.cri.Container(m.id)
+			if err == nil {
+				info.Name = details.Name
+				info.Image = details.Image
+				info.Labels = details.Labels
+			}
+			complete = complete && answered(err)
+		}
+		var podComplete bool
+		info.Pod, podComplete = r.pod(m.podUID)
+		complete = complete && podComplete
+	}
+	if complete {
+		r.cache[m.id] = info
+	}
+	return info
+}
+
+// pod returns the details of a pod, asking the CRI runtime once per pod,
+// and whether the runtime answered. r.mu must be held.
+func (r *Resolver) pod(uid string) (*types.PodInfo, bool) {
+	if pod, ok := r.pods[uid]; ok {
+		return pod, true
+	}
+	pod := &types.PodInfo{UID: uid}
+	if r.cri != nil {
+		details, err := r.cri.Pod(uid)
+		if err == nil {
+			pod.Name = details.Name
+			pod.Namespace = details.Namespace
+			pod.Labels = details.Labels
+		}
+		if !answered(err) {
+			return pod, false
+		}
+	}
+	r.pods[uid] = pod
+	return pod, true
+}
+
+// answered reports whether a runtime answered a lookup that returned err,
+// if only that the container or pod is unknown
+func answered(err error) bool {
+	return err == nil || errors.Is(err, ErrNotFound)
+}
+
+// Find resolves a container name, ID or ID prefix to the container and its
+// cgroup path below the cgroup root. Names need the runtime; IDs are also
+// found from the cgroups of running processes.
+func (r *Resolver) Find(ref string) (*types.ContainerInfo, string, error) {
+	if r.client != nil {
+		_, pid, err := r.client.Inspect(ref)
+		if err == nil {
+			if pid == 0 {
+				return nil, "", fmt.Errorf("container %s is not running", ref)
+			}
+			path, err := readCgroup(r.procRoot, int32(pid))
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to read cgroup of container %s: %w", ref, err)
+			}
+			m, ok := parseCgroupPath(path)
+			if !ok {
+				return nil, "", fmt.Errorf("cgroup %s of container %s does not follow a known naming convention", path, ref)
+			}
+			return r.info(m), m.cgroup, nil
+		}
+	}
+
+	m, err := r.findByID(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	return r.info(m), m.cgroup, nil
+}
+
+// findByID looks for a running container whose ID starts with prefix in
+// the cgroups of all processes
+func (r *Resolver) findByID(prefix string) (cgroupMatch, error) {
+	entries, err := os.ReadDir(r.procRoot)
+	if err != nil {
+		return cgroupMatch{}, err
+	}
+
+	found := make(map[string]cgroupMatch)
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		path, err := readCgroup(r.procRoot, int32(pid))
+		if err != nil {
+			continue // Exited meanwhile
+		}
+		if m, ok := parseCgroupPath(path); ok && strings.HasPrefix(m.id, prefix) {
+			found[m.id] = m
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return cgroupMatch{}, fmt.Errorf("no running container %s found", prefix)
+	case 1:
+		for _, m := range found {
+			return m, nil
+		}
+	}
+	return cgroupMatch{}, fmt.Errorf("container ID prefix %s is ambiguous", prefix)
+}
@@ -0,0 +1,158 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	webID  = "0a4e2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f"
+	dbID   = "0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+	podUID = "5c1f2e3d-4b5a-6978-8a9b-0c1d2e3f4a5b"
+)
+
+func TestParseCgroupPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		ok      bool
+		id      string
+		runtime string
+		cgroup  string
+		podUID  string
+	}{
+		{"/system.slice/docker-" + webID + ".scope", true, webID, "docker", "/system.slice/docker-" + webID + ".scope", ""},
+		{"/docker/" + webID, true, webID, "docker", "/docker/" + webID, ""},
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod5c1f2e3d_4b5a_6978_8a9b_0c1d2e3f4a5b.slice/cri-containerd-" + webID + ".scope",
+			true, webID, "containerd", "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod5c1f2e3d_4b5a_6978_8a9b_0c1d2e3f4a5b.slice/cri-containerd-" + webID + ".scope", podUID},
+		{"/kubepods.slice/kubepods-pod5c1f2e3d_4b5a_6978_8a9b_0c1d2e3f4a5b.slice/crio-" + webID + ".scope",
+			true, webID, "cri-o", "/kubepods.slice/kubepods-pod5c1f2e3d_4b5a_6978_8a9b_0c1d2e3f4a5b.slice/crio-" + webID + ".scope", podUID},
+		{"/machine.slice/libpod-" + webID + ".scope/container", true, webID, "podman", "/machine.slice/libpod-" + webID + ".scope", ""},
+		{"/kubepods/besteffort/pod" + podUID + "/" + webID, true, webID, "", "/kubepods/besteffort/pod" + podUID + "/" + webID, podUID},
+		{"/kubepods/besteffort/pod1234/" + webID, true, webID, "", "/kubepods/besteffort/pod1234/" + webID, ""},
+		// Nested containers belong to the innermost one
+		{"/docker/" + dbID + "/docker/" + webID, true, webID, "docker", "/docker/" + dbID + "/docker/" + webID, ""},
+		{"/user.slice/user-1000.slice/session-2.scope", false, "", "", "", ""},
+		{"/system.slice/docker-1234.scope", false, "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		m, ok := parseCgroupPath(tt.path)
+		if ok != tt.ok || m.id != tt.id || m.runtime != tt.runtime || m.cgroup != tt.cgroup || m.podUID != tt.podUID {
+			t.Errorf("parseCgroupPath(%q) = %+v, %v; want %s %q %s %s", tt.path, m, ok, tt.id, tt.runtime, tt.cgroup, tt.podUID)
+		}
+	}
+}
+
+// writeProcCgroup creates /proc/<pid>/cgroup under root
+func writeProcCgroup(t *testing.T, root string, pid int, path string) {
+	t.Helper()
+	dir := filepath.Join(root, fmt.Sprint(pid))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::"+path+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeRuntime serves container inspect requests on a unix socket, counting
+// requests
+func fakeRuntime(t *testing.T, requests *int) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		if ref != "web" && ref != webID {
+			http.NotFound(w, r)
+			return
+		}
+		var resp inspectResponse
+		resp.ID = webID
+		resp.Name = "/web"
+		resp.Config.Image = "nginx:1.27"
+		resp.Config.Labels = map[string]string{"app": "shop"}
+		resp.State.Pid = 100
+		json.NewEncoder(w).Encode(resp)
+	}))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+func TestResolver(t *testing.T) {
+	procRoot := t.TempDir()
+	writeProcCgroup(t, procRoot, 100, "/system.slice/docker-"+webID+".scope")
+	writeProcCgroup(t, procRoot, 101, "/system.slice/docker-"+webID+".scope")
+	writeProcCgroup(t, procRoot, 200, "/kubepods/besteffort/pod"+podUID+"/"+dbID)
+	writeProcCgroup(t, procRoot, 300, "/user.slice/user-1000.slice/session-2.scope")
+
+	var requests int
+	r := NewResolver(fakeRuntime(t, &requests), "")
+	r.procRoot = procRoot
+
+	info := r.Container(100)
+	if info == nil || info.ID != webID || info.Name != "web" || info.Image != "nginx:1.27" ||
+		info.Runtime != "docker" || info.Labels["app"] != "shop" {
+		t.Errorf("Container(100) = %+v", info)
+	}
+	if r.Container(101) != info || requests != 1 {
+		t.Errorf("Expected cached details, got %d requests", requests)
+	}
+	if r.Container(300) != nil {
+		t.Error("Expected no container for a host process")
+	}
+
+	// Unknown to the runtime; only the IDs are known
+	if info := r.Container(200); info == nil || info.ID != dbID || info.Name != "" || info.Pod == nil || info.Pod.UID != podUID {
+		t.Errorf("Container(200) = %+v", info)
+	}
+
+	// By name through the runtime, by ID prefix from cgroups
+	info, cgroup, err := r.Find("web")
+	if err != nil || info.ID != webID || cgroup != "/system.slice/docker-"+webID+".scope" {
+		t.Errorf("Find(web) = %+v, %q, %v", info, cgroup, err)
+	}
+	info, cgroup, err = r.Find(dbID[:12])
+	if err != nil || info.ID != dbID || cgroup != "/kubepods/besteffort/pod"+podUID+"/"+dbID {
+		t.Errorf("Find(%s) = %+v, %q, %v", dbID[:12], info, cgroup, err)
+	}
+	if _, _, err := r.Find("0a"); err == nil {
+		t.Error("Expected error for ambiguous ID prefix")
+	}
+	if _, _, err := r.Find("missing"); err == nil {
+		t.Error("Expected error for unknown container")
+	}
+}
+
+func TestResolverRuntimeDown(t *testing.T) {
+	procRoot := t.TempDir()
+	writeProcCgroup(t, procRoot, 100, "/system.slice/docker-"+webID+".scope")
+
+	r := NewResolver(filepath.Join(t.TempDir(), "docker.sock"), "")
+	r.procRoot = procRoot
+
+	if info := r.Container(100); info == nil || info.ID != webID || info.Name != "" {
+		t.Fatalf("Container(100) = %+v", info)
+	}
+
+	// Details are found once the runtime is up
+	var requests int
+	r.client = NewClient(fakeRuntime(t, &requests))
+	if info := r.Container(100); info == nil || info.Name != "web" {
+		t.Errorf("Container(100) = %+v", info)
+	}
+}
@@ -0,0 +1,290 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// criService is the gRPC service of the CRI runtime API
+const criService = "/runtime.v1.RuntimeService/"
+
+// podUIDLabel is the label kubelet puts on pod sandboxes with the pod UID
+const podUIDLabel = "io.kubernetes.pod.uid"
+
+// CRIClient talks to the Kubernetes Container Runtime Interface of a
+// container runtime, e.g. containerd or CRI-O, over its local socket. CRI is
+// gRPC; the few calls we make are encoded by hand.
+type CRIClient struct {
+	http *http.Client
+}
+
+// PodDetails holds what the runtime reports about a pod
+type PodDetails struct {
+	UID       string
+	Name      string
+	Namespace string
+	Labels    map[string]string
+}
+
+// NewCRIClient creates a client for the CRI runtime listening on socket
+func NewCRIClient(socket string) *CRIClient {
+	return &CRIClient{
+		http: &http.Client{
+			Timeout: clientTimeout,
+			Transport: &http2.Transport{
+				// gRPC over the socket is HTTP/2 without TLS
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, _, _ string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Pod returns the details of the pod with the given UID
+func (c *CRIClient) Pod(uid string) (*PodDetails, error) {
+	// ListPodSandboxRequest{filter: PodSandboxFilter{label_selector}}
+	filter := appendMapEntry(nil, 3, podUIDLabel, uid)
+	resp, err := c.call("ListPodSandbox", appendBytes(nil, 1, filter))
+	if err != nil {
+		return nil, err
+	}
+
+	// ListPodSandboxResponse{items: PodSandbox{metadata, labels}}; pods have
+	// a new sandbox after restarts, all with the same metadata
+	var pod *PodDetails
+	err = parseProto(resp, func(field int, item []byte) error {
+		if field != 1 || pod != nil {
+			return nil
+		}
+		p := &PodDetails{Labels: make(map[string]string)}
+		err := parseProto(item, func(field int, value []byte) error {
+			switch field {
+			case 2: // PodSandboxMetadata{name, uid, namespace}
+				return parseProto(value, func(field int, value []byte) error {
+					switch field {
+					case 1:
+						p.Name = string(value)
+					case 2:
+						p.UID = string(value)
+					case 3:
+						p.Namespace = string(value)
+					}
+					return nil
+				})
+			case 5:
+				return parseMapEntry(value, p.Labels)
+			}
+			return nil
+		})
+		if err == nil && p.UID == uid {
+			pod = p
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pod %s: %w", uid, err)
+	}
+	if pod == nil {
+		return nil, fmt.Errorf("%w: pod %s", ErrNotFound, uid)
+	}
+	return pod, nil
+}
+
+// Container returns the details of a container given by ID. Its name is the
+// name of the container within its pod.
+func (c *CRIClient) Container(id string) (*Details, error) {
+	// ListContainersRequest{filter: ContainerFilter{id}}
+	filter := appendBytes(nil, 1, []byte(id))
+	resp, err := c.call("ListContainers", appendBytes(nil, 1, filter))
+	if err != nil {
+		return nil, err
+	}
+
+	// ListContainersResponse{containers: Container{id, metadata, image, labels}}
+	var found *Details
+	err = parseProto(resp, func(field int, item []byte) error {
+		if field != 1 || found != nil {
+			return nil
+		}
+		d := &Details{Labels: make(map[string]string)}
+		err := parseProto(item, func(field int, value []byte) error {
+			switch field {
+			case 1:
+				d.ID = string(value)
+			case 3: // ContainerMetadata{name}
+				return parseProto(value, func(field int, value []byte) error {
+					if field == 1 {
+						d.Name = string(value)
+					}
+					return nil
+				})
+			case 4: // ImageSpec{image}
+				return parseProto(value, func(field int, value []byte) error {
+					if field == 1 {
+						d.Image = string(value)
+					}
+					return nil
+				})
+			case 8:
+				return parseMapEntry(value, d.Labels)
+			}
+			return nil
+		})
+		if err == nil && d.ID == id {
+			found = d
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode container %s: %w", id, err)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return found, nil
+}
+
+// call makes a unary gRPC call to the runtime service and returns the
+// encoded response message
+func (c *CRIClient) call(method string, msg []byte) ([]byte, error) {
+	// Messages are framed by a compression flag and their length
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	// The host is ignored when dialing the socket
+	req, err := http.NewRequest(http.MethodPost, "http://runtime"+criService+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ask CRI runtime: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRI runtime returned %s for %s", resp.Status, method)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CRI %s response: %w", method, err)
+	}
+
+	// Errors without a message come in the headers rather than the trailers
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return nil, fmt.Errorf("CRI %s failed with status %s: %s", method, status, message)
+	}
+
+	if len(data) < 5 {
+		return nil, fmt.Errorf("short CRI %s response", method)
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("compressed CRI %s response not supported", method)
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint32(len(data)-5) < n {
+		return nil, fmt.Errorf("truncated CRI %s response", method)
+	}
+	return data[5 : 5+n], nil
+}
+
+// Protocol buffer wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// appendBytes appends a length-delimited field, a string or an embedded
+// message, to a protocol buffer message
+func appendBytes(msg []byte, field int, value []byte) []byte {
+	msg = binary.AppendUvarint(msg, uint64(field)<<3|wireBytes)
+	msg = binary.AppendUvarint(msg, uint64(len(value)))
+	return append(msg, value...)
+}
+
+// appendMapEntry appends an entry of a map<string, string> field
+func appendMapEntry(msg []byte, field int, key, value string) []byte {
+	entry := appendBytes(nil, 1, []byte(key))
+	entry = appendBytes(entry, 2, []byte(value))
+	return appendBytes(msg, field, entry)
+}
+
+// parseProto calls fn with the length-delimited fields of a protocol buffer
+// message, skipping the others
+func parseProto(msg []byte, fn func(field int, value []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		msg = msg[n:]
+
+		var size uint64
+		switch tag & 7 {
+		case wireVarint:
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			size = uint64(n)
+		case wireFixed64:
+			size = 8
+		case wireFixed32:
+			size = 4
+		case wireBytes:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return errors.New("invalid field length")
+			}
+			if err := fn(int(tag>>3), msg[n:n+int(length)]); err != nil {
+				return err
+			}
+			size = uint64(n) + length
+		default:
+			return fmt.Errorf("unsupported wire type %d", tag&7)
+		}
+		if size > uint64(len(msg)) {
+			return errors.New("truncated message")
+		}
+		msg = msg[size:]
+	}
+	return nil
+}
+
+// parseMapEntry adds an entry of a map<string, string> field to m
+func parseMapEntry(entry []byte, m map[string]string) error {
+	var key, value string
+	err := parseProto(entry, func(field int, v []byte) error {
+		switch field {
+		case 1:
+			key = string(v)
+		case 2:
+			value = string(v)
+		}
+		return nil
+	})
+	if err == nil {
+		m[key] = value
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package container
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// fakeCRI serves the CRI calls of CRIClient on a unix socket, knowing pod
+// shop/web-0 with container db
+func fakeCRI(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "containerd.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || len(body) < 5 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		req := body[5:]
+
+		var resp []byte
+		switch path.Base(r.URL.Path) {
+		case "ListPodSandbox":
+			labels := make(map[string]string)
+			parseProto(req, func(field int, filter []byte) error {
+				return parseProto(filter, func(field int, value []byte) error {
+					if field == 3 {
+						return parseMapEntry(value, labels)
+					}
+					return nil
+				})
+			})
+			if labels[podUIDLabel] == podUID {
+				meta := appendBytes(nil, 1, []byte("web-0"))
+				meta = appendBytes(meta, 2, []byte(podUID))
+				meta = appendBytes(meta, 3, []byte("shop"))
+				item := appendBytes(nil, 1, []byte("sandbox"))
+				item = appendBytes(item, 2, meta)
+				// State, a varint to be skipped
+				item = binary.AppendUvarint(item, 3<<3|wireVarint)
+				item = binary.AppendUvarint(item, 1)
+				item = appendMapEntry(item, 5, "app", "shop")
+				resp = appendBytes(nil, 1, item)
+			}
+		case "ListContainers":
+			var id string
+			parseProto(req, func(field int, filter []byte) error {
+				return parseProto(filter, func(field int, value []byte) error {
+					if field == 1 {
+						id = string(value)
+					}
+					return nil
+				})
+			})
+			if id == dbID {
+				c := appendBytes(nil, 1, []byte(dbID))
+				c = appendBytes(c, 3, appendBytes(nil, 1, []byte("db")))
+				c = appendBytes(c, 4, appendBytes(nil, 1, []byte("postgres:16")))
+				resp = appendBytes(nil, 1, c)
+			}
+		default:
+			w.Header().Set("Grpc-Status", "12") // Unimplemented
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+		w.Write(append(frame, resp...))
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	srv := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return socket
+}
+
+func TestCRIClient(t *testing.T) {
+	c := NewCRIClient(fakeCRI(t))
+
+	pod, err := c.Pod(podUID)
+	if err != nil || pod.Name != "web-0" || pod.Namespace != "shop" || pod.Labels["app"] != "shop" {
+		t.Errorf("Pod(%s) = %+v, %v", podUID, pod, err)
+	}
+	if _, err := c.Pod("00000000-0000-0000-0000-000000000000"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for unknown pod, got %v", err)
+	}
+
+	details, err := c.Container(dbID)
+	if err != nil || details.Name != "db" || details.Image != "postgres:16" {
+		t.Errorf("Container(%s) = %+v, %v", dbID, details, err)
+	}
+	if _, err := c.Container(webID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for unknown container, got %v", err)
+	}
+	if _, err := c.call("Version", nil); err == nil {
+		t.Error("Expected error for failed call")
+	}
+}
+
+func TestResolverPods(t *testing.T) {
+	procRoot := t.TempDir()
+	writeProcCgroup(t, procRoot, 200, "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod5c1f2e3d_4b5a_6978_8a9b_0c1d2e3f4a5b.slice/cri-containerd-"+dbID+".scope")
+	writeProcCgroup(t, procRoot, 201, "/system.slice/containerd.service")
+
+	r := NewResolver("", fakeCRI(t))
+	r.procRoot = procRoot
+
+	info := r.Container(200)
+	if info == nil || info.Name != "db" || info.Image != "postgres:16" || info.Runtime != "containerd" {
+		t.Fatalf("Container(200) = %+v", info)
+	}
+	if pod := info.Pod; pod == nil || pod.UID != podUID || pod.Name != "web-0" || pod.Namespace != "shop" || pod.Labels["app"] != "shop" {
+		t.Errorf("Pod = %+v", pod)
+	}
+	if r.Container(201) != nil {
+		t.Error("Expected no container for the runtime itself")
+	}
+}
@@ -3,6 +3,7 @@ package output
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,34 +17,87 @@ type Formatter struct {
 	useJSON     bool
 	useColor    bool
 	showDetails bool
+	showDNS     bool
+	showHTTP    bool
+	showHist    bool
+	groupBy     GroupBy
 }
 
 // Config holds formatter configuration
 type Config struct {
-	JSONOutput  bool
-	UseColor    bool
-	ShowDetails bool
+	JSONOutput     bool
+	UseColor       bool
+	ShowDetails    bool
+	ShowDNS        bool
+	ShowHTTP       bool
+	ShowHistograms bool
+	GroupBy        GroupBy // Combine rows per pod, namespace or container
 }
 
+// histogramWidth is the width of the bars of ASCII histograms
+const histogramWidth = 40
+
 // processStats represents JSON output for a single process
 type processStats struct {
-	PID         int32                           `json:"pid"`
+	PID         int32                           `json:"pid,omitempty"`
 	Name        string                          `json:"name"`
+	Cgroup      string                          `json:"cgroup,omitempty"`
+	Container   *types.ContainerInfo            `json:"container,omitempty"`
+	Group       string                          `json:"group,omitempty"`
 	Runtime     string                          `json:"runtime"`
+	Exited      bool                            `json:"exited,omitempty"`
 	Current     *types.NetworkStats             `json:"current"`
 	Peak        *types.NetworkStats             `json:"peak"`
 	Total       *types.NetworkStats             `json:"total"`
 	Connections map[string]types.ConnectionInfo `json:"connections,omitempty"`
+	DNS         []dnsJSON                       `json:"dns,omitempty"`
+}
+
+// dnsJSON represents a DNS query of a process in JSON output
+type dnsJSON struct {
+	Timestamp string  `json:"timestamp"`
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	RCode     string  `json:"rcode"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Server    string  `json:"server"`
+	Protocol  string  `json:"protocol"`
 }
 
 // aggregatedStats represents JSON output for combined statistics
 type aggregatedStats struct {
-	BytesIn        uint64  `json:"bytes_in"`
-	BytesOut       uint64  `json:"bytes_out"`
-	RateIn         float64 `json:"rate_in"`
-	RateOut        float64 `json:"rate_out"`
-	TCPConnections uint32  `json:"tcp_connections"`
-	UDPConnections uint32  `json:"udp_connections"`
+	BytesIn        uint64                        `json:"bytes_in"`
+	BytesOut       uint64                        `json:"bytes_out"`
+	RateIn         float64                       `json:"rate_in"`
+	RateOut        float64                       `json:"rate_out"`
+	TCPConnections uint32                        `json:"tcp_connections"`
+	UDPConnections uint32                        `json:"udp_connections"`
+	TCPStates      map[string]uint32             `json:"tcp_states"`
+	IPv4           types.TrafficStats            `json:"ipv4"`
+	IPv6           types.TrafficStats            `json:"ipv6"`
+	Socket         types.TrafficStats            `json:"socket"`
+	Retransmits    uint64                        `json:"retransmits"`
+	RSTIn          uint64                        `json:"rst_in"`
+	RSTOut         uint64                        `json:"rst_out"`
+	Drops          map[string]uint64             `json:"drops"`
+	Interfaces     map[string]types.TrafficStats `json:"interfaces"`
+	SNI            map[string]types.TrafficStats `json:"sni"`
+}
+
+// eventJSON represents a connection event as a line of NDJSON output
+type eventJSON struct {
+	Timestamp  string  `json:"timestamp"`
+	Type       string  `json:"type"`
+	PID        int32   `json:"pid"`
+	Name       string  `json:"name"`
+	Protocol   string  `json:"protocol"`
+	LocalAddr  string  `json:"local_addr"`
+	RemoteAddr string  `json:"remote_addr"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	BytesIn    uint64  `json:"bytes_in,omitempty"`
+	BytesOut   uint64  `json:"bytes_out,omitempty"`
+	PacketsIn  uint64  `json:"packets_in,omitempty"`
+	PacketsOut uint64  `json:"packets_out,omitempty"`
 }
 
 // jsonOutput represents the complete JSON output structure
@@ -59,17 +113,66 @@ func New(cfg Config) *Formatter {
 		useJSON:     cfg.JSONOutput,
 		useColor:    cfg.UseColor,
 		showDetails: cfg.ShowDetails,
+		showDNS:     cfg.ShowDNS,
+		showHTTP:    cfg.ShowHTTP,
+		showHist:    cfg.ShowHistograms,
+		groupBy:     cfg.GroupBy,
 	}
 }
 
 // FormatStats formats process statistics
 func (f *Formatter) FormatStats(stats map[int32]*types.ProcessStats) string {
+	if f.groupBy != GroupNone {
+		stats = groupStats(stats, f.groupBy)
+	}
 	if f.useJSON {
 		return f.formatJSON(stats)
 	}
 	return f.formatTable(stats)
 }
 
+// FormatEvent formats a connection event as a single line: text, or a JSON
+// object for NDJSON streams
+func (f *Formatter) FormatEvent(ev types.ConnEvent) string {
+	if f.useJSON {
+		data, err := json.Marshal(eventJSON{
+			Timestamp:  ev.Time.Format(time.RFC3339Nano),
+			Type:       string(ev.Type),
+			PID:        ev.PID,
+			Name:       ev.Comm,
+			Protocol:   ev.Protocol,
+			LocalAddr:  ev.LocalAddr,
+			RemoteAddr: ev.RemoteAddr,
+			DurationMS: float64(ev.Duration) / float64(time.Millisecond),
+			BytesIn:    ev.BytesIn,
+			BytesOut:   ev.BytesOut,
+			PacketsIn:  ev.PacketsIn,
+			PacketsOut: ev.PacketsOut,
+		})
+		if err != nil {
+			return fmt.Sprintf("Error formatting JSON: %v\n", err)
+		}
+		return string(data) + "\n"
+	}
+
+	var what string
+	switch ev.Type {
+	case types.ConnConnect:
+		what = fmt.Sprintf("connected to %s from %s", ev.RemoteAddr, ev.LocalAddr)
+	case types.ConnAccept:
+		what = fmt.Sprintf("accepted from %s on %s", ev.RemoteAddr, ev.LocalAddr)
+	case types.ConnClose:
+		what = fmt.Sprintf("connection %s -> %s closed after %s / %s",
+			ev.LocalAddr, ev.RemoteAddr,
+			types.FormatBytes(ev.BytesIn+ev.BytesOut),
+			ev.Duration.Round(100*time.Millisecond))
+	default:
+		what = fmt.Sprintf("%s %s -> %s", ev.Type, ev.LocalAddr, ev.RemoteAddr)
+	}
+
+	return fmt.Sprintf("%s pid %d (%s) %s\n", ev.Time.Format("15:04:05.000"), ev.PID, ev.Comm, what)
+}
+
 // formatJSON converts statistics to JSON
 func (f *Formatter) formatJSON(stats map[int32]*types.ProcessStats) string {
 	output := jsonOutput{
@@ -77,21 +180,29 @@ func (f *Formatter) formatJSON(stats map[int32]*types.ProcessStats) string {
 		Processes: make(map[string]processStats),
 	}
 
-	totalIn, totalOut := uint64(0), uint64(0)
-	totalRateIn, totalRateOut := float64(0), float64(0)
-	totalTCP, totalUDP := uint32(0), uint32(0)
+	aggregate := types.NetworkStats{
+		TCPStates:  make(map[string]uint32),
+		Interfaces: make(map[string]types.TrafficStats),
+		Drops:      make(map[string]uint64),
+		SNI:        make(map[string]types.TrafficStats),
+	}
 
 	for pid, procStats := range stats {
 		current, peak, total := procStats.GetStats()
+		_, exited := procStats.Exited()
 
 		// Create process stats
 		pStats := processStats{
-			PID:     pid,
-			Name:    procStats.Comm,
-			Runtime: time.Since(procStats.StartTime).Round(time.Second).String(),
-			Current: &current,
-			Peak:    &peak,
-			Total:   &total,
+			PID:       pid,
+			Name:      procStats.Comm,
+			Cgroup:    procStats.Cgroup,
+			Container: procStats.Container,
+			Group:     procStats.Group,
+			Runtime:   procStats.Runtime().Round(time.Second).String(),
+			Exited:    exited,
+			Current:   &current,
+			Peak:      &peak,
+			Total:     &total,
 		}
 
 		// Add connections if details are requested
@@ -99,24 +210,55 @@ func (f *Formatter) formatJSON(stats map[int32]*types.ProcessStats) string {
 			pStats.Connections = current.ActiveConns
 		}
 
-		// Add to output
-		output.Processes[fmt.Sprintf("%d", pid)] = pStats
+		// Add DNS queries if requested
+		if f.showDNS {
+			pStats.DNS = make([]dnsJSON, 0, len(current.DNS))
+			for _, q := range current.DNS {
+				pStats.DNS = append(pStats.DNS, dnsJSON{
+					Timestamp: q.Time.Format(time.RFC3339Nano),
+					Name:      q.Name,
+					Type:      q.Type,
+					RCode:     q.RCode,
+					LatencyMS: float64(q.Latency) / float64(time.Millisecond),
+					Server:    q.Server,
+					Protocol:  q.Protocol,
+				})
+			}
+		}
 
-		totalIn += current.BytesIn
-		totalOut += current.BytesOut
-		totalRateIn += current.CurrentRateIn
-		totalRateOut += current.CurrentRateOut
-		totalTCP += current.TCPConnections
-		totalUDP += current.UDPConnections
+		// Add to output; rows covering a cgroup are keyed by its path, and
+		// groups by their name
+		key := fmt.Sprintf("%d", pid)
+		switch {
+		case procStats.Group != "":
+			pStats.PID = 0
+			key = procStats.Comm
+		case procStats.Cgroup != "":
+			pStats.PID = 0
+			key = procStats.Cgroup
+		}
+		output.Processes[key] = pStats
+
+		aggregate.Add(current)
 	}
 
 	output.Aggregated = &aggregatedStats{
-		BytesIn:        totalIn,
-		BytesOut:       totalOut,
-		RateIn:         totalRateIn,
-		RateOut:        totalRateOut,
-		TCPConnections: totalTCP,
-		UDPConnections: totalUDP,
+		BytesIn:        aggregate.BytesIn,
+		BytesOut:       aggregate.BytesOut,
+		RateIn:         aggregate.CurrentRateIn,
+		RateOut:        aggregate.CurrentRateOut,
+		TCPConnections: aggregate.TCPConnections,
+		UDPConnections: aggregate.UDPConnections,
+		TCPStates:      aggregate.TCPStates,
+		Interfaces:     aggregate.Interfaces,
+		IPv4:           aggregate.IPv4,
+		IPv6:           aggregate.IPv6,
+		Socket:         aggregate.Socket,
+		Retransmits:    aggregate.Retransmits,
+		RSTIn:          aggregate.RSTIn,
+		RSTOut:         aggregate.RSTOut,
+		Drops:          aggregate.Drops,
+		SNI:            aggregate.SNI,
 	}
 
 	jsonData, err := json.MarshalIndent(output, "", "  ")
@@ -136,6 +278,7 @@ func (f *Formatter) formatTable(stats map[int32]*types.ProcessStats) string {
 	table.SetHeader([]string{
 		"PID",
 		"Name",
+		"Container",
 		"Runtime",
 		"Rate In",
 		"Rate Out",
@@ -143,6 +286,10 @@ func (f *Formatter) formatTable(stats map[int32]*types.ProcessStats) string {
 		"Total Out",
 		"TCP",
 		"UDP",
+		"Retrans",
+		"RST In/Out",
+		"SRTT",
+		"Drops",
 	})
 	table.SetBorder(true)
 	table.SetRowLine(true)
@@ -165,20 +312,28 @@ func (f *Formatter) formatTable(stats map[int32]*types.ProcessStats) string {
 	totalIn, totalOut := uint64(0), uint64(0)
 	totalRateIn, totalRateOut := float64(0), float64(0)
 	totalTCP, totalUDP := uint32(0), uint32(0)
+	totalRetrans, totalRSTIn, totalRSTOut := uint64(0), uint64(0), uint64(0)
+	totalDrops := uint64(0)
 
 	for pid, procStats := range stats {
 		current, _, total := procStats.GetStats()
+		drops := sumCounts(current.Drops)
 
 		table.Append([]string{
-			fmt.Sprintf("%d", pid),
+			rowPID(pid, procStats),
 			procStats.Comm,
-			time.Since(procStats.StartTime).Round(time.Second).String(),
+			formatContainer(procStats.Container),
+			formatRuntime(procStats),
 			green(types.FormatRate(current.CurrentRateIn)),
 			green(types.FormatRate(current.CurrentRateOut)),
 			yellow(types.FormatBytes(total.BytesIn)),
 			yellow(types.FormatBytes(total.BytesOut)),
 			fmt.Sprintf("%d", current.TCPConnections),
 			fmt.Sprintf("%d", current.UDPConnections),
+			fmt.Sprintf("%d", current.Retransmits),
+			fmt.Sprintf("%d/%d", current.RSTIn, current.RSTOut),
+			formatRTT(current.SRTT, current.RTTVar),
+			fmt.Sprintf("%d", drops),
 		})
 
 		totalIn += total.BytesIn
@@ -187,6 +342,10 @@ func (f *Formatter) formatTable(stats map[int32]*types.ProcessStats) string {
 		totalRateOut += current.CurrentRateOut
 		totalTCP += current.TCPConnections
 		totalUDP += current.UDPConnections
+		totalRetrans += current.Retransmits
+		totalRSTIn += current.RSTIn
+		totalRSTOut += current.RSTOut
+		totalDrops += drops
 	}
 
 	// Add totals row
@@ -194,29 +353,129 @@ func (f *Formatter) formatTable(stats map[int32]*types.ProcessStats) string {
 		"",
 		"TOTAL",
 		"",
+		"",
 		green(types.FormatRate(totalRateIn)),
 		green(types.FormatRate(totalRateOut)),
 		yellow(types.FormatBytes(totalIn)),
 		yellow(types.FormatBytes(totalOut)),
 		fmt.Sprintf("%d", totalTCP),
 		fmt.Sprintf("%d", totalUDP),
+		fmt.Sprintf("%d", totalRetrans),
+		fmt.Sprintf("%d/%d", totalRSTIn, totalRSTOut),
+		"",
+		fmt.Sprintf("%d", totalDrops),
 	})
 
 	table.Render()
 
+	// Break down drops by reason
+	if totalDrops > 0 {
+		sb.WriteString("\nDrops:\n")
+		for pid, procStats := range stats {
+			current, _, _ := procStats.GetStats()
+			if len(current.Drops) > 0 {
+				sb.WriteString(fmt.Sprintf("  %s: %s\n", rowLabel(pid, procStats), formatCounts(current.Drops)))
+			}
+		}
+	}
+
+	// Add DNS queries if requested
+	if f.showDNS {
+		sb.WriteString("\nDNS Queries:\n")
+		for pid, procStats := range stats {
+			current, _, _ := procStats.GetStats()
+			if len(current.DNS) == 0 {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("\n%s:\n", rowLabel(pid, procStats)))
+			for _, q := range current.DNS {
+				sb.WriteString("  " + formatDNSQuery(q) + "\n")
+			}
+		}
+	}
+
+	// Add histograms if requested
+	if f.showHist {
+		sb.WriteString("\nHistograms:\n")
+		for pid, procStats := range stats {
+			current, _, _ := procStats.GetStats()
+			if current.Histograms == nil {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("\n%s:\n", rowLabel(pid, procStats)))
+			sb.WriteString(formatHistogram("Packet size in", "bytes", current.Histograms.SizeIn))
+			sb.WriteString(formatHistogram("Packet size out", "bytes", current.Histograms.SizeOut))
+			sb.WriteString(formatHistogram("Packet gap in", "us", current.Histograms.GapIn))
+			sb.WriteString(formatHistogram("Packet gap out", "us", current.Histograms.GapOut))
+		}
+	}
+
+	// Add HTTP statistics if requested
+	if f.showHTTP {
+		sb.WriteString("\nHTTP:\n")
+		for pid, procStats := range stats {
+			current, _, _ := procStats.GetStats()
+			if current.HTTP == nil {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("\n%s:\n", rowLabel(pid, procStats)))
+			sb.WriteString(formatHTTP(current.HTTP))
+		}
+	}
+
 	// Add connection details if requested
 	if f.showDetails {
 		sb.WriteString("\nActive Connections:\n")
 		for pid, procStats := range stats {
 			current, _, _ := procStats.GetStats()
 			if len(current.ActiveConns) > 0 {
-				sb.WriteString(fmt.Sprintf("\nPID %d (%s):\n", pid, procStats.Comm))
+				sb.WriteString(fmt.Sprintf("\n%s:\n", rowLabel(pid, procStats)))
+				if len(current.TCPStates) > 0 {
+					sb.WriteString(fmt.Sprintf("  TCP states: %s\n", formatCounts(current.TCPStates)))
+				}
+				if len(current.Interfaces) > 0 {
+					sb.WriteString(fmt.Sprintf("  Interfaces: %s\n", formatInterfaces(current.Interfaces)))
+				}
+				if len(current.SNI) > 0 {
+					sb.WriteString(fmt.Sprintf("  TLS servers: %s\n", formatServerNames(current.SNI)))
+				}
+				if current.Socket != (types.TrafficStats{}) {
+					sb.WriteString(fmt.Sprintf("  Socket payload: in %s out %s\n",
+						types.FormatBytes(current.Socket.BytesIn),
+						types.FormatBytes(current.Socket.BytesOut)))
+				}
 				for _, conn := range current.ActiveConns {
-					sb.WriteString(fmt.Sprintf("  %s: %s -> %s (%s)\n",
+					state := ""
+					if conn.State != "" {
+						state = fmt.Sprintf(" (%s)", conn.State)
+					}
+					health := ""
+					if conn.SRTT > 0 {
+						health += " rtt " + formatRTT(conn.SRTT, conn.RTTVar)
+					}
+					if conn.Retransmits > 0 || conn.RSTs > 0 {
+						health += fmt.Sprintf(" retrans %d rst %d", conn.Retransmits, conn.RSTs)
+					}
+					remote := conn.RemoteAddr
+					if conn.SNI != "" {
+						remote += " (" + conn.SNI + ")"
+					}
+					payload := ""
+					if conn.SocketIn > 0 || conn.SocketOut > 0 {
+						payload = fmt.Sprintf(" (payload in %s out %s)",
+							types.FormatBytes(conn.SocketIn),
+							types.FormatBytes(conn.SocketOut))
+					}
+					sb.WriteString(fmt.Sprintf("  %s: %s -> %s%s in %s out %s%s, %s%s\n",
 						conn.Protocol,
 						conn.LocalAddr,
-						conn.RemoteAddr,
-						conn.State,
+						remote,
+						state,
+						types.FormatBytes(conn.BytesIn),
+						types.FormatBytes(conn.BytesOut),
+						payload,
+						conn.LastUpdated.Sub(conn.FirstSeen).Round(time.Millisecond),
+						health,
 					))
 				}
 			}
@@ -225,3 +484,185 @@ func (f *Formatter) formatTable(stats map[int32]*types.ProcessStats) string {
 
 	return sb.String()
 }
+
+// rowPID renders the PID column of a row; rows covering a cgroup or a group
+// have none
+func rowPID(pid int32, procStats *types.ProcessStats) string {
+	if procStats.Cgroup != "" || procStats.Group != "" {
+		return "-"
+	}
+	return fmt.Sprintf("%d", pid)
+}
+
+// rowLabel names a row in the sections following the table
+func rowLabel(pid int32, procStats *types.ProcessStats) string {
+	if procStats.Group != "" {
+		return strings.ToUpper(procStats.Group[:1]) + procStats.Group[1:] + " " + procStats.Comm
+	}
+	if procStats.Cgroup != "" {
+		return "Cgroup " + procStats.Cgroup
+	}
+	return fmt.Sprintf("PID %d (%s)", pid, procStats.Comm)
+}
+
+// formatContainer renders the container column: the container name, or
+// its short ID if the runtime could not be asked
+func formatContainer(c *types.ContainerInfo) string {
+	if c == nil {
+		return ""
+	}
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.ShortID()
+}
+
+// formatRuntime renders how long a process has been monitored, marking
+// processes that have exited
+func formatRuntime(procStats *types.ProcessStats) string {
+	runtime := procStats.Runtime().Round(time.Second).String()
+	if _, exited := procStats.Exited(); exited {
+		runtime += " (exited)"
+	}
+	return runtime
+}
+
+// formatRTT renders a smoothed round-trip time and its variance, or "-" if
+// no TCP round-trip time was sampled
+func formatRTT(srtt, rttvar time.Duration) string {
+	if srtt == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%s ±%s", srtt.Round(10*time.Microsecond), rttvar.Round(10*time.Microsecond))
+}
+
+// formatDNSQuery renders a DNS query with its outcome on one line
+func formatDNSQuery(q types.DNSQuery) string {
+	latency := "-"
+	if q.RCode != types.DNSTimeout {
+		latency = q.Latency.Round(10 * time.Microsecond).String()
+	}
+	return fmt.Sprintf("%s %s %s %s %s via %s/%s",
+		q.Time.Format("15:04:05.000"), q.Name, q.Type, q.RCode, latency, q.Server, q.Protocol)
+}
+
+// formatHistogram renders a log2 histogram as ASCII bars, from its first
+// to its last non-empty bucket, or nothing if it is empty
+func formatHistogram(title, unit string, h types.Histogram) string {
+	first, max := -1, uint64(0)
+	for i, n := range h {
+		if n > 0 && first < 0 {
+			first = i
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("  %s (%s):\n", title, unit))
+	for i := first; i < len(h); i++ {
+		low, high := types.BucketRange(i)
+		bar := int(h[i] * histogramWidth / max)
+		sb.WriteString(fmt.Sprintf("  %10d -> %-10d : %-10d |%-*s|\n",
+			low, high, h[i], histogramWidth, strings.Repeat("*", bar)))
+	}
+	return sb.String()
+}
+
+// formatHTTP renders the HTTP statistics of a process, with path prefixes
+// ordered by request count
+func formatHTTP(http *types.HTTPStats) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("  %d requests, %d responses\n", http.Requests, http.Responses))
+	if len(http.Methods) > 0 {
+		sb.WriteString(fmt.Sprintf("  Methods: %s\n", formatCounts(http.Methods)))
+	}
+	if len(http.Statuses) > 0 {
+		sb.WriteString(fmt.Sprintf("  Statuses: %s\n", formatCounts(http.Statuses)))
+	}
+
+	paths := make([]string, 0, len(http.Paths))
+	for path := range http.Paths {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := http.Paths[paths[i]], http.Paths[paths[j]]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return paths[i] < paths[j]
+	})
+	for _, path := range paths {
+		p := http.Paths[path]
+		sb.WriteString(fmt.Sprintf("  %s: %d requests, %s\n", path, p.Requests, types.FormatBytes(p.Bytes)))
+	}
+	return sb.String()
+}
+
+// formatCounts renders named counters, such as sockets per TCP state or
+// drops per reason, as sorted "NAME=n" pairs
+func formatCounts[T uint32 | uint64](counts map[string]T) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, counts[name]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// sumCounts adds up named counters
+func sumCounts(counts map[string]uint64) uint64 {
+	var sum uint64
+	for _, n := range counts {
+		sum += n
+	}
+	return sum
+}
+
+// formatServerNames renders traffic per TLS server name as "name: X"
+// entries, busiest first
+func formatServerNames(traffic map[string]types.TrafficStats) string {
+	names := make([]string, 0, len(traffic))
+	for name := range traffic {
+		names = append(names, name)
+	}
+	bytes := func(name string) uint64 { return traffic[name].BytesIn + traffic[name].BytesOut }
+	sort.Slice(names, func(i, j int) bool {
+		if bytes(names[i]) != bytes(names[j]) {
+			return bytes(names[i]) > bytes(names[j])
+		}
+		return names[i] < names[j]
+	})
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %s", name, types.FormatBytes(bytes(name))))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatInterfaces renders per-interface traffic as "name in X out Y" entries
+func formatInterfaces(ifaces map[string]types.TrafficStats) string {
+	names := make([]string, 0, len(ifaces))
+	for name := range ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s in %s out %s", name,
+			types.FormatBytes(ifaces[name].BytesIn),
+			types.FormatBytes(ifaces[name].BytesOut)))
+	}
+	return strings.Join(parts, ", ")
+}
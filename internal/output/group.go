@@ -0,0 +1,118 @@
+package output
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// GroupBy selects what rows are combined by
+type GroupBy int
+
+const (
+	// GroupNone shows every monitored process, cgroup or unit on its own
+	GroupNone GroupBy = iota
+	// GroupPod combines the rows of each Kubernetes pod
+	GroupPod
+	// GroupNamespace combines the rows of each Kubernetes namespace
+	GroupNamespace
+	// GroupContainer combines the rows of each container
+	GroupContainer
+)
+
+// noGroup names the group of rows outside any pod, namespace or container,
+// or whose pod is unknown to the runtime
+const noGroup = "(none)"
+
+// ParseGroupBy parses a grouping name: "pod", "namespace" or "container", or
+// empty for no grouping
+func ParseGroupBy(name string) (GroupBy, error) {
+	switch name {
+	case "":
+		return GroupNone, nil
+	case "pod":
+		return GroupPod, nil
+	case "namespace":
+		return GroupNamespace, nil
+	case "container":
+		return GroupContainer, nil
+	default:
+		return 0, fmt.Errorf("unknown grouping %q (want pod, namespace or container)", name)
+	}
+}
+
+// String returns the name of the grouping
+func (g GroupBy) String() string {
+	switch g {
+	case GroupPod:
+		return "pod"
+	case GroupNamespace:
+		return "namespace"
+	case GroupContainer:
+		return "container"
+	default:
+		return ""
+	}
+}
+
+// groupStats combines rows into one row per group, keyed below zero in the
+// order of the group names
+func groupStats(stats map[int32]*types.ProcessStats, by GroupBy) map[int32]*types.ProcessStats {
+	members := make(map[string][]*types.ProcessStats)
+	for _, procStats := range stats {
+		name := groupName(procStats, by)
+		members[name] = append(members[name], procStats)
+	}
+
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	grouped := make(map[int32]*types.ProcessStats, len(names))
+	for i, name := range names {
+		key := -int32(i + 1)
+		group := types.GroupStats(key, by.String(), name, members[name])
+		if by == GroupContainer {
+			group.Container = members[name][0].Container
+		}
+		grouped[key] = group
+	}
+	return grouped
+}
+
+// groupName names the group a row belongs to: namespace/pod for pods, and
+// namespace/pod/container for containers in pods
+func groupName(procStats *types.ProcessStats, by GroupBy) string {
+	c := procStats.Container
+	if c == nil {
+		return noGroup
+	}
+	switch by {
+	case GroupPod:
+		if c.Pod != nil {
+			return podName(c.Pod)
+		}
+	case GroupNamespace:
+		if c.Pod != nil && c.Pod.Namespace != "" {
+			return c.Pod.Namespace
+		}
+	case GroupContainer:
+		if c.Pod != nil {
+			return podName(c.Pod) + "/" + formatContainer(c)
+		}
+		return formatContainer(c)
+	}
+	return noGroup
+}
+
+// podName names a pod as namespace/name, or by its UID if the runtime could
+// not be asked
+func podName(pod *types.PodInfo) string {
+	if pod.Name == "" {
+		return pod.UID
+	}
+	return pod.Namespace + "/" + pod.Name
+}
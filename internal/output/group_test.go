@@ -0,0 +1,85 @@
+package output
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+func TestParseGroupBy(t *testing.T) {
+	for _, name := range []string{"", "pod", "namespace", "container"} {
+		g, err := ParseGroupBy(name)
+		if err != nil || g.String() != name {
+			t.Errorf("ParseGroupBy(%q) = %v, %v", name, g, err)
+		}
+	}
+	if _, err := ParseGroupBy("node"); err == nil {
+		t.Error("Expected error for unknown grouping")
+	}
+}
+
+func TestGroupStats(t *testing.T) {
+	web := &types.PodInfo{UID: "5c1f2e3d-4b5a-6978-8a9b-0c1d2e3f4a5b", Name: "web-0", Namespace: "shop"}
+	db := &types.PodInfo{UID: "6d2a3f4e-5c6b-7a89-9bac-1d2e3f4a5b6c", Name: "db-0", Namespace: "shop"}
+	nginx := &types.ContainerInfo{ID: "a", Name: "nginx", Pod: web}
+	sidecar := &types.ContainerInfo{ID: "b", Name: "envoy", Pod: web}
+	postgres := &types.ContainerInfo{ID: "c", Name: "postgres", Pod: db}
+
+	row := func(pid int32, c *types.ContainerInfo, bytesIn uint64, rate float64) *types.ProcessStats {
+		ps := types.NewProcessStats(pid, "proc")
+		ps.Container = c
+		ps.Update(types.NetworkStats{BytesIn: bytesIn, CurrentRateIn: rate, PacketsIn: 1})
+		return ps
+	}
+	stats := map[int32]*types.ProcessStats{
+		1: row(1, nginx, 100, 10),
+		2: row(2, nginx, 200, 20),
+		3: row(3, sidecar, 400, 40),
+		4: row(4, postgres, 800, 80),
+		5: row(5, nil, 1600, 160),
+	}
+
+	tests := []struct {
+		by    GroupBy
+		total map[string]uint64 // Total bytes in per group
+	}{
+		{GroupPod, map[string]uint64{"shop/web-0": 700, "shop/db-0": 800, noGroup: 1600}},
+		{GroupNamespace, map[string]uint64{"shop": 1500, noGroup: 1600}},
+		{GroupContainer, map[string]uint64{"shop/web-0/nginx": 300, "shop/web-0/envoy": 400, "shop/db-0/postgres": 800, noGroup: 1600}},
+	}
+	for _, tt := range tests {
+		grouped := groupStats(stats, tt.by)
+		if len(grouped) != len(tt.total) {
+			t.Errorf("%s: got %d groups, want %d", tt.by, len(grouped), len(tt.total))
+		}
+		for key, group := range grouped {
+			current, _, total := group.GetStats()
+			if key >= 0 || group.Group != tt.by.String() {
+				t.Errorf("%s: group %q keyed %d as %q", tt.by, group.Comm, key, group.Group)
+			}
+			if total.BytesIn != tt.total[group.Comm] || current.CurrentRateIn != float64(tt.total[group.Comm])/10 {
+				t.Errorf("%s: group %q has %d bytes at %.0f B/s, want %d", tt.by, group.Comm, total.BytesIn, current.CurrentRateIn, tt.total[group.Comm])
+			}
+		}
+	}
+
+	// Groups replace rows in the output
+	f := New(Config{JSONOutput: true, GroupBy: GroupPod})
+	var out jsonOutput
+	if err := json.Unmarshal([]byte(f.FormatStats(stats)), &out); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := out.Processes["shop/web-0"]; !ok || p.Group != "pod" || p.PID != 0 || len(out.Processes) != 3 {
+		t.Errorf("JSON processes = %+v", out.Processes)
+	}
+	if out.Aggregated.BytesIn != 3100 {
+		t.Errorf("Aggregated bytes in = %d, want 3100", out.Aggregated.BytesIn)
+	}
+
+	table := New(Config{GroupBy: GroupNamespace}).FormatStats(stats)
+	if !strings.Contains(table, "shop") || strings.Contains(table, "proc") {
+		t.Errorf("Table does not show namespace rows:\n%s", table)
+	}
+}
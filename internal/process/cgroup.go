@@ -0,0 +1,180 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// unitTypes are the systemd unit types that have a cgroup
+var unitTypes = []string{".service", ".scope", ".slice"}
+
+// CgroupFilter is implemented by PID filters that can also restrict
+// accounting to the processes of cgroups
+type CgroupFilter interface {
+	AddCgroup(id uint64, key uint32) error
+	RemoveCgroup(id uint64) error
+}
+
+// unit is a cgroup whose processes are monitored together, as one row
+type unit struct {
+	path string // Cgroup directory
+	id   uint64 // Cgroup ID, 0 while the cgroup does not exist
+}
+
+// AddCgroup monitors all processes in a cgroup v2 and its descendant
+// cgroups as one row, including processes that join later. The path may be
+// absolute or relative to the cgroup root.
+func (m *Monitor) AddCgroup(path string) error {
+	return m.addCgroup("", path, nil)
+}
+
+// AddContainer monitors all processes of a running container, given by
+// name, ID or ID prefix, as one row like AddCgroup. A container resolver
+// must be set.
+func (m *Monitor) AddContainer(ref string) error {
+	if m.containers == nil {
+		return errors.New("no container resolver set")
+	}
+	info, path, err := m.containers.Find(ref)
+	if err != nil {
+		return err
+	}
+	name := info.Name
+	if name == "" {
+		name = info.ShortID()
+	}
+	return m.addCgroup(name, path, info)
+}
+
+// addCgroup monitors the cgroup at path, absolute or relative to the cgroup
+// root, as a row named name or after the path
+func (m *Monitor) addCgroup(name, path string, container *types.ContainerInfo) error {
+	dir := path
+	if !strings.HasPrefix(dir, m.cgroupRoot+"/") {
+		dir = filepath.Join(m.cgroupRoot, path)
+	}
+	id, err := cgroupID(dir)
+	if err != nil {
+		return fmt.Errorf("failed to access cgroup %s: %w", path, err)
+	}
+	if name == "" {
+		name = strings.TrimPrefix(dir, m.cgroupRoot)
+	}
+	return m.addUnit(name, dir, id, container)
+}
+
+// AddUnit monitors all processes of a systemd unit as one row, like
+// AddCgroup. Names without a unit type are taken to be services.
+func (m *Monitor) AddUnit(name string) error {
+	hasType := false
+	for _, typ := range unitTypes {
+		hasType = hasType || strings.HasSuffix(name, typ)
+	}
+	if !hasType {
+		name += ".service"
+	}
+
+	dir, err := findUnitCgroup(m.cgroupRoot, name)
+	if err != nil {
+		return err
+	}
+	id, err := cgroupID(dir)
+	if err != nil {
+		return fmt.Errorf("failed to access cgroup of unit %s: %w", name, err)
+	}
+	return m.addUnit(name, dir, id, nil)
+}
+
+// addUnit monitors the cgroup at dir under a new key, named name
+func (m *Monitor) addUnit(name, dir string, id uint64, container *types.ContainerInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Units are keyed below zero, which the kernel sees above any PID
+	key := -int32(len(m.units) + 1)
+	if cf, ok := m.filter.(CgroupFilter); ok {
+		if err := cf.AddCgroup(id, uint32(key)); err != nil {
+			return err
+		}
+	} else if m.filter != nil {
+		return errors.New("PID filter does not support cgroups")
+	}
+
+	procStats := types.NewProcessStats(key, name)
+	procStats.Cgroup = strings.TrimPrefix(dir, m.cgroupRoot)
+	procStats.Container = container
+	m.pids[key] = procStats
+	m.units[key] = &unit{path: dir, id: id}
+	return nil
+}
+
+// checkUnits follows monitored cgroups as they are removed and created
+// again, e.g. when systemd restarts a service. m.mu must be held.
+func (m *Monitor) checkUnits() {
+	cf, _ := m.filter.(CgroupFilter)
+
+	for key, u := range m.units {
+		id, err := cgroupID(u.path)
+		if err != nil {
+			id = 0
+		}
+		if id == u.id {
+			continue
+		}
+		if cf != nil && u.id != 0 {
+			cf.RemoveCgroup(u.id)
+		}
+		if cf != nil && id != 0 {
+			if err := cf.AddCgroup(id, uint32(key)); err != nil {
+				id = 0 // Retried on the next check
+			}
+		}
+		u.id = id
+	}
+}
+
+// findUnitCgroup finds the cgroup of a running systemd unit below root
+func findUnitCgroup(root, name string) (string, error) {
+	var found string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Removed meanwhile, or not readable
+		}
+		if d.IsDir() && d.Name() == name {
+			found = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("no cgroup found for unit %s; is it running?", name)
+	}
+	return found, nil
+}
+
+// cgroupID returns the ID of a cgroup v2, which is the inode number of its
+// directory
+func cgroupID(dir string) (uint64, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return 0, fmt.Errorf("%s is not a cgroup directory", dir)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("cannot read inode of %s", dir)
+	}
+	return stat.Ino, nil
+}
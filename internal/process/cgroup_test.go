@@ -0,0 +1,160 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// fakeCgroupFilter records the PIDs and cgroups it is given
+type fakeCgroupFilter struct {
+	fakeFilter
+	cgroups map[uint64]uint32
+}
+
+func (f *fakeCgroupFilter) AddCgroup(id uint64, key uint32) error {
+	f.cgroups[id] = key
+	return nil
+}
+
+func (f *fakeCgroupFilter) RemoveCgroup(id uint64) error {
+	delete(f.cgroups, id)
+	return nil
+}
+
+func TestMonitorUnits(t *testing.T) {
+	root := t.TempDir()
+	service := filepath.Join(root, "system.slice", "nginx.service")
+	if err := os.MkdirAll(service, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	mon := New()
+	mon.cgroupRoot = root
+	if err := mon.AddUnit("nginx"); err != nil {
+		t.Fatalf("AddUnit failed: %v", err)
+	}
+	if err := mon.AddCgroup("/system.slice"); err != nil {
+		t.Fatalf("AddCgroup failed: %v", err)
+	}
+	if err := mon.AddUnit("missing.service"); err == nil {
+		t.Error("Expected error for unit without cgroup")
+	}
+
+	if err := mon.SetPIDFilter(&fakeFilter{pids: make(map[uint32]bool)}); err == nil {
+		t.Error("Expected error for filter without cgroup support")
+	}
+	filter := &fakeCgroupFilter{fakeFilter{pids: make(map[uint32]bool)}, make(map[uint64]uint32)}
+	if err := mon.SetPIDFilter(filter); err != nil {
+		t.Fatalf("SetPIDFilter failed: %v", err)
+	}
+
+	id, err := cgroupID(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := mon.GetProcessStats(-1)
+	if err != nil {
+		t.Fatalf("Unit row missing: %v", err)
+	}
+	if stats.Comm != "nginx.service" || stats.Cgroup != "/system.slice/nginx.service" {
+		t.Errorf("Unit row = %q at %q", stats.Comm, stats.Cgroup)
+	}
+	if key, ok := filter.cgroups[id]; !ok || int32(key) != -1 {
+		t.Errorf("Expected cgroup %d in filter under key -1, got %v", id, filter.cgroups)
+	}
+	if len(filter.cgroups) != 2 || len(filter.pids) != 0 {
+		t.Errorf("Filter holds cgroups %v and PIDs %v", filter.cgroups, filter.pids)
+	}
+
+	// A restarted service gets a new cgroup, followed under the same key
+	if err := os.Remove(service); err != nil {
+		t.Fatal(err)
+	}
+	mon.checkProcesses()
+	if _, ok := filter.cgroups[id]; ok {
+		t.Error("Expected removed cgroup to leave the filter")
+	}
+	if err := os.Mkdir(service, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mon.checkProcesses()
+
+	newID, err := cgroupID(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := filter.cgroups[newID]; !ok || int32(key) != -1 {
+		t.Errorf("Expected new cgroup %d in filter under key -1, got %v", newID, filter.cgroups)
+	}
+	if _, exited := stats.Exited(); exited {
+		t.Error("Unit rows must not exit")
+	}
+	if pids := mon.GetMonitoredPIDs(); len(pids) != 2 {
+		t.Errorf("Expected 2 unit rows monitored, got %v", pids)
+	}
+}
+
+// fakeResolver knows a single container
+type fakeResolver struct {
+	info   *types.ContainerInfo
+	cgroup string
+	pids   map[int32]bool // Processes running in the container
+}
+
+func (r *fakeResolver) Container(pid int32) *types.ContainerInfo {
+	if r.pids[pid] {
+		return r.info
+	}
+	return nil
+}
+
+func (r *fakeResolver) Find(ref string) (*types.ContainerInfo, string, error) {
+	if ref != r.info.Name {
+		return nil, "", errors.New("no such container")
+	}
+	return r.info, r.cgroup, nil
+}
+
+func TestMonitorContainers(t *testing.T) {
+	root := t.TempDir()
+	cgroup := "/system.slice/docker-0a1b2c3d.scope"
+	if err := os.MkdirAll(filepath.Join(root, cgroup), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	pid := int32(os.Getpid())
+	info := &types.ContainerInfo{ID: "0a1b2c3d", Name: "web", Image: "nginx:1.27"}
+	mon := New()
+	mon.cgroupRoot = root
+	if err := mon.AddContainer("web"); err == nil {
+		t.Error("Expected error without a container resolver")
+	}
+	mon.SetContainerResolver(&fakeResolver{info: info, cgroup: cgroup, pids: map[int32]bool{pid: true}})
+
+	if err := mon.AddContainer("web"); err != nil {
+		t.Fatalf("AddContainer failed: %v", err)
+	}
+	if err := mon.AddContainer("db"); err == nil {
+		t.Error("Expected error for unknown container")
+	}
+	stats, err := mon.GetProcessStats(-1)
+	if err != nil {
+		t.Fatalf("Container row missing: %v", err)
+	}
+	if stats.Comm != "web" || stats.Cgroup != cgroup || stats.Container != info {
+		t.Errorf("Container row = %q at %q in %+v", stats.Comm, stats.Cgroup, stats.Container)
+	}
+
+	// Processes are labelled with their container
+	if err := mon.AddProcess(fmt.Sprint(pid)); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := mon.GetProcessStats(pid); stats.Container != info {
+		t.Errorf("Process container = %+v, want %+v", stats.Container, info)
+	}
+}
@@ -0,0 +1,73 @@
+package process
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// Launch starts cmd and monitors it from its first instruction on. The
+// child is traced so that it stops right after exec; it is only let go once
+// it has been added to the monitor and the PID filter, so none of its
+// traffic is missed. The caller waits for cmd as usual.
+func (m *Monitor) Launch(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Ptrace = true
+
+	// Ptrace requests must come from the thread that started the child
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+
+	// Wait for the stop at exec, which may not have happened yet
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &status, 0, nil); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("failed to wait for process %d to start: %w", pid, err)
+	}
+	if !status.Stopped() {
+		return fmt.Errorf("process %d did not stop at exec", pid)
+	}
+
+	if err := m.addLaunched(int32(pid)); err != nil {
+		cmd.Process.Kill()
+		syscall.PtraceDetach(pid)
+		return err
+	}
+
+	// Resume the child, discarding the SIGTRAP of the exec
+	if err := syscall.PtraceDetach(pid); err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("failed to resume process %d: %w", pid, err)
+	}
+	return nil
+}
+
+// addLaunched monitors a process started by Launch
+func (m *Monitor) addLaunched(pid int32) error {
+	// Already holds the name of the executed program
+	comm, err := m.getProcessName(pid)
+	if err != nil {
+		return fmt.Errorf("failed to access process %d: %w", pid, err)
+	}
+
+	procStats := newProcessStats(m.containerResolver(), pid, comm)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filter != nil {
+		if err := m.filter.AddPID(uint32(pid)); err != nil {
+			return err
+		}
+	}
+	m.pids[pid] = procStats
+	return nil
+}
@@ -1,6 +1,7 @@
 package process
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -14,17 +15,82 @@ import (
 
 // Monitor handles process monitoring and validation
 type Monitor struct {
-	mu      sync.RWMutex
-	pids    map[int32]*types.ProcessStats
-	stopped chan struct{}
+	mu         sync.RWMutex
+	pids       map[int32]*types.ProcessStats
+	filter     PIDFilter
+	stopped    chan struct{}
+	procRoot   string
+	selectors  []Selector
+	selected   map[int32]bool // Processes dropped once they exit: matched or observed
+	matched    map[int32]bool // Selected processes that matched a selector, dropped once they no longer do
+	cgroupRoot string
+	units      map[int32]*unit // Cgroups monitored as one row, by their key
+	containers ContainerResolver
+}
+
+// PIDFilter is kept in sync with the set of monitored processes, e.g. to
+// restrict in-kernel accounting to them
+type PIDFilter interface {
+	AddPID(pid uint32) error
+	RemovePID(pid uint32) error
+}
+
+// ContainerResolver finds the containers processes run in
+type ContainerResolver interface {
+	// Container returns the container a process runs in, or nil
+	Container(pid int32) *types.ContainerInfo
+	// Find resolves a container name, ID or ID prefix to the container and
+	// its cgroup path below the cgroup root
+	Find(ref string) (*types.ContainerInfo, string, error)
 }
 
 // New creates a new process monitor
 func New() *Monitor {
 	return &Monitor{
-		pids:    make(map[int32]*types.ProcessStats),
-		stopped: make(chan struct{}),
+		pids:       make(map[int32]*types.ProcessStats),
+		stopped:    make(chan struct{}),
+		procRoot:   "/proc",
+		selected:   make(map[int32]bool),
+		matched:    make(map[int32]bool),
+		cgroupRoot: "/sys/fs/cgroup",
+		units:      make(map[int32]*unit),
+	}
+}
+
+// AddSelector monitors all processes matching sel, including ones started
+// later. Processes are matched when the monitor starts and on every check
+// after; those that exit or no longer match, e.g. after executing another
+// program, are dropped.
+func (m *Monitor) AddSelector(sel Selector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.selectors = append(m.selectors, sel)
+}
+
+// SetContainerResolver registers a resolver to label processes with the
+// container they run in. It must be set before processes are added.
+func (m *Monitor) SetContainerResolver(r ContainerResolver) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.containers = r
+}
+
+// containerResolver returns the registered container resolver, if any
+func (m *Monitor) containerResolver() ContainerResolver {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.containers
+}
+
+// newProcessStats creates the statistics of a process, labelled with its
+// container if containers is set. The resolver may ask the container
+// runtime, so m.mu should not be held.
+func newProcessStats(containers ContainerResolver, pid int32, comm string) *types.ProcessStats {
+	procStats := types.NewProcessStats(pid, comm)
+	if containers != nil {
+		procStats.Container = containers.Container(pid)
 	}
+	return procStats
 }
 
 // AddProcess adds a process to be monitored
@@ -40,11 +106,38 @@ func (m *Monitor) AddProcess(pidStr string) error {
 		return fmt.Errorf("failed to access process %d: %w", pid, err)
 	}
 
+	procStats := newProcessStats(m.containerResolver(), int32(pid), comm)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.filter != nil {
+		if err := m.filter.AddPID(uint32(pid)); err != nil {
+			return err
+		}
+	}
+
 	// Add to monitoring
-	m.pids[int32(pid)] = types.NewProcessStats(int32(pid), comm)
+	m.pids[int32(pid)] = procStats
+	return nil
+}
+
+// Observe shows a process without adding it to the PID filter, e.g. one the
+// kernel accounts because every process is. Like processes picked by a
+// selector, it is dropped once it has exited.
+func (m *Monitor) Observe(pid int32) error {
+	comm, err := m.getProcessName(pid)
+	if err != nil {
+		return fmt.Errorf("failed to access process %d: %w", pid, err)
+	}
+	procStats := newProcessStats(m.containerResolver(), pid, comm)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.pids[pid]; !exists {
+		m.pids[pid] = procStats
+		m.selected[pid] = true
+	}
 	return nil
 }
 
@@ -52,16 +145,76 @@ func (m *Monitor) AddProcess(pidStr string) error {
 func (m *Monitor) RemoveProcess(pid int32) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.removeLocked(pid)
+}
+
+// removeLocked drops a process from monitoring; m.mu must be held
+func (m *Monitor) removeLocked(pid int32) {
 	delete(m.pids, pid)
+	delete(m.selected, pid)
+	delete(m.matched, pid)
+	if m.filter != nil {
+		m.filter.RemovePID(uint32(pid))
+	}
 }
 
-// GetMonitoredPIDs returns a list of currently monitored PIDs
+// SetPIDFilter registers a filter to keep in sync with the monitored
+// processes. Processes and cgroups already being monitored are added to it;
+// monitoring cgroups requires a CgroupFilter.
+func (m *Monitor) SetPIDFilter(filter PIDFilter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for pid := range m.pids {
+		if _, ok := m.units[pid]; ok {
+			continue
+		}
+		if err := filter.AddPID(uint32(pid)); err != nil {
+			return err
+		}
+	}
+	if len(m.units) > 0 {
+		cf, ok := filter.(CgroupFilter)
+		if !ok {
+			return errors.New("PID filter does not support cgroups")
+		}
+		for key, u := range m.units {
+			if err := cf.AddCgroup(u.id, uint32(key)); err != nil {
+				return err
+			}
+		}
+	}
+	m.filter = filter
+	return nil
+}
+
+// Exit records the final statistics of a monitored process that has
+// exited. The process stays in GetAllStats but is no longer monitored.
+func (m *Monitor) Exit(pid int32, final types.NetworkStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	procStats, exists := m.pids[pid]
+	if !exists {
+		return
+	}
+	procStats.Exit(final)
+	if m.filter != nil {
+		m.filter.RemovePID(uint32(pid))
+	}
+}
+
+// GetMonitoredPIDs returns a list of currently monitored PIDs, excluding
+// processes that have exited
 func (m *Monitor) GetMonitoredPIDs() []int32 {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	pids := make([]int32, 0, len(m.pids))
-	for pid := range m.pids {
+	for pid, procStats := range m.pids {
+		if _, exited := procStats.Exited(); exited {
+			continue
+		}
 		pids = append(pids, pid)
 	}
 	return pids
@@ -79,8 +232,10 @@ func (m *Monitor) GetProcessStats(pid int32) (*types.ProcessStats, error) {
 	return stats, nil
 }
 
-// Start begins process monitoring
+// Start begins process monitoring, picking up processes that match the
+// selectors right away
 func (m *Monitor) Start() {
+	m.scan()
 	go m.monitor()
 }
 
@@ -98,28 +253,127 @@ func (m *Monitor) monitor() {
 		select {
 		case <-ticker.C:
 			m.checkProcesses()
+			m.scan()
 		case <-m.stopped:
 			return
 		}
 	}
 }
 
-// checkProcesses verifies monitored processes still exist
+// checkProcesses verifies monitored processes still exist. Processes that
+// vanished without an exit record keep their last statistics; a late exit
+// record still replaces them with the exact final tally. Processes picked by
+// a selector are dropped once they have exited. Cgroup rows never exit.
 func (m *Monitor) checkProcesses() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for pid := range m.pids {
+	m.checkUnits()
+
+	for pid, procStats := range m.pids {
+		if _, ok := m.units[pid]; ok {
+			continue
+		}
+		if _, exited := procStats.Exited(); exited {
+			if m.selected[pid] {
+				m.removeLocked(pid)
+			}
+			continue
+		}
 		if _, err := m.getProcessName(pid); err != nil {
 			// Process no longer exists or accessible
-			delete(m.pids, pid)
+			current, _, _ := procStats.GetStats()
+			procStats.Exit(current)
+			if m.filter != nil {
+				m.filter.RemovePID(uint32(pid))
+			}
+		}
+	}
+}
+
+// scan adds the running processes that match any selector and are not
+// monitored yet, and drops those added by a selector that no longer match
+func (m *Monitor) scan() {
+	m.mu.RLock()
+	selectors := m.selectors
+	containers := m.containers
+	known := make(map[int32]bool, len(m.pids))
+	for pid := range m.pids {
+		known[pid] = true
+	}
+	recheck := make(map[int32]bool, len(m.matched))
+	for pid := range m.matched {
+		recheck[pid] = true
+	}
+	m.mu.RUnlock()
+
+	if len(selectors) == 0 {
+		return
+	}
+	exe := false
+	for _, sel := range selectors {
+		exe = exe || sel.needsExe()
+	}
+
+	entries, err := os.ReadDir(m.procRoot)
+	if err != nil {
+		return
+	}
+
+	// Never select ourselves, e.g. for a pattern given on our command line
+	self := int32(os.Getpid())
+
+	matched := make(map[int32]*types.ProcessStats)
+	var unmatched []int32
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil || (known[int32(pid)] && !recheck[int32(pid)]) || int32(pid) == self {
+			continue
+		}
+		info, err := readProcInfo(m.procRoot, int32(pid), exe)
+		if err != nil {
+			continue // Exited in the meantime
+		}
+		match := false
+		for _, sel := range selectors {
+			if sel.matches(info) {
+				match = true
+				break
+			}
+		}
+		switch {
+		case recheck[int32(pid)] && !match:
+			unmatched = append(unmatched, int32(pid))
+		case !known[int32(pid)] && match:
+			matched[int32(pid)] = newProcessStats(containers, int32(pid), info.comm)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pid := range unmatched {
+		if m.matched[pid] {
+			m.removeLocked(pid)
+		}
+	}
+	for pid, procStats := range matched {
+		if _, exists := m.pids[pid]; exists {
+			continue
+		}
+		if m.filter != nil {
+			if err := m.filter.AddPID(uint32(pid)); err != nil {
+				continue
+			}
 		}
+		m.pids[pid] = procStats
+		m.selected[pid] = true
+		m.matched[pid] = true
 	}
 }
 
 // getProcessName reads the process name from /proc/[pid]/comm
 func (m *Monitor) getProcessName(pid int32) (string, error) {
-	commPath := filepath.Join("/proc", strconv.FormatInt(int64(pid), 10), "comm")
+	commPath := filepath.Join(m.procRoot, strconv.FormatInt(int64(pid), 10), "comm")
 	data, err := os.ReadFile(commPath)
 	if err != nil {
 		return "", err
@@ -135,7 +389,7 @@ func (m *Monitor) ValidatePermissions(pid int32) error {
 	}
 
 	// Check if we can read process information
-	procPath := filepath.Join("/proc", strconv.FormatInt(int64(pid), 10))
+	procPath := filepath.Join(m.procRoot, strconv.FormatInt(int64(pid), 10))
 	if _, err := os.Stat(procPath); err != nil {
 		return fmt.Errorf("cannot access process information: %w", err)
 	}
@@ -0,0 +1,176 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bkohler/procnetmon2/pkg/types"
+)
+
+// fakeFilter records the PIDs it is given
+type fakeFilter struct {
+	pids map[uint32]bool
+}
+
+func (f *fakeFilter) AddPID(pid uint32) error {
+	f.pids[pid] = true
+	return nil
+}
+
+func (f *fakeFilter) RemovePID(pid uint32) error {
+	delete(f.pids, pid)
+	return nil
+}
+
+func TestPIDFilterSync(t *testing.T) {
+	pid := int32(os.Getpid())
+	mon := New()
+
+	if err := mon.AddProcess(strconv.Itoa(int(pid))); err != nil {
+		t.Fatalf("AddProcess failed: %v", err)
+	}
+
+	// Existing processes are synced when the filter is set
+	filter := &fakeFilter{pids: make(map[uint32]bool)}
+	if err := mon.SetPIDFilter(filter); err != nil {
+		t.Fatalf("SetPIDFilter failed: %v", err)
+	}
+	if !filter.pids[uint32(pid)] {
+		t.Errorf("Expected PID %d in filter after SetPIDFilter", pid)
+	}
+
+	mon.RemoveProcess(pid)
+	if filter.pids[uint32(pid)] {
+		t.Errorf("Expected PID %d removed from filter", pid)
+	}
+
+	if err := mon.AddProcess(strconv.Itoa(int(pid))); err != nil {
+		t.Fatalf("AddProcess failed: %v", err)
+	}
+	if !filter.pids[uint32(pid)] {
+		t.Errorf("Expected PID %d in filter after AddProcess", pid)
+	}
+}
+
+func TestProcessExit(t *testing.T) {
+	pid := int32(os.Getpid())
+	mon := New()
+	filter := &fakeFilter{pids: make(map[uint32]bool)}
+	if err := mon.SetPIDFilter(filter); err != nil {
+		t.Fatalf("SetPIDFilter failed: %v", err)
+	}
+	if err := mon.AddProcess(strconv.Itoa(int(pid))); err != nil {
+		t.Fatalf("AddProcess failed: %v", err)
+	}
+
+	mon.Exit(pid, types.NetworkStats{BytesIn: 1000, BytesOut: 2000})
+
+	if len(mon.GetMonitoredPIDs()) != 0 {
+		t.Errorf("Expected no monitored PIDs after exit, got %v", mon.GetMonitoredPIDs())
+	}
+	if filter.pids[uint32(pid)] {
+		t.Errorf("Expected PID %d removed from filter after exit", pid)
+	}
+
+	// The final tally stays available
+	stats, ok := mon.GetAllStats()[pid]
+	if !ok {
+		t.Fatalf("Expected PID %d in stats after exit", pid)
+	}
+	if _, exited := stats.Exited(); !exited {
+		t.Errorf("Expected PID %d marked as exited", pid)
+	}
+	current, _, _ := stats.GetStats()
+	if current.BytesIn != 1000 || current.BytesOut != 2000 {
+		t.Errorf("Final stats = %d/%d, want 1000/2000", current.BytesIn, current.BytesOut)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	pid := int32(os.Getpid())
+	mon := New()
+	filter := &fakeFilter{pids: make(map[uint32]bool)}
+	if err := mon.SetPIDFilter(filter); err != nil {
+		t.Fatalf("SetPIDFilter failed: %v", err)
+	}
+
+	if err := mon.Observe(pid); err != nil {
+		t.Fatalf("Observe failed: %v", err)
+	}
+	if _, err := mon.GetProcessStats(pid); err != nil {
+		t.Errorf("Expected PID %d shown after Observe: %v", pid, err)
+	}
+	if filter.pids[uint32(pid)] {
+		t.Errorf("Expected PID %d kept out of the filter", pid)
+	}
+	if err := mon.Observe(1 << 30); err == nil {
+		t.Error("Expected error for nonexistent process")
+	}
+
+	// Observed processes go once they have exited
+	mon.Exit(pid, types.NetworkStats{})
+	mon.checkProcesses()
+	if _, err := mon.GetProcessStats(pid); err == nil {
+		t.Errorf("Expected PID %d dropped after exit", pid)
+	}
+}
+
+// stateFilter records the state of processes when they are added
+type stateFilter struct {
+	states map[uint32]string
+}
+
+func (f *stateFilter) AddPID(pid uint32) error {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return err
+	}
+	stat := string(data)
+	f.states[pid] = strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])[0]
+	return nil
+}
+
+func (f *stateFilter) RemovePID(pid uint32) error {
+	return nil
+}
+
+func TestLaunch(t *testing.T) {
+	mon := New()
+	filter := &stateFilter{states: make(map[uint32]string)}
+	if err := mon.SetPIDFilter(filter); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sh", "-c", "exit 3")
+	if err := mon.Launch(cmd); err != nil {
+		t.Fatalf("Launch failed: %v", err)
+	}
+	pid := uint32(cmd.Process.Pid)
+
+	// Added while stopped at exec, under the name of the executed program
+	if state := filter.states[pid]; state != "t" {
+		t.Errorf("Process state when added = %q, want t (stopped by tracer)", state)
+	}
+	stats, err := mon.GetProcessStats(int32(pid))
+	if err != nil {
+		t.Fatalf("Launched process not monitored: %v", err)
+	}
+	if stats.Comm != "sh" {
+		t.Errorf("Process name = %q, want sh", stats.Comm)
+	}
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("Wait = %v, want exit status 3", err)
+	}
+
+	if err := mon.Launch(exec.Command("/nonexistent")); err == nil {
+		t.Error("Expected error launching a missing program")
+	}
+}
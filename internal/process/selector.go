@@ -0,0 +1,168 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Selector picks processes to monitor by their properties. Every criterion
+// that is set must match; a criterion with several values matches if any of
+// them does. Names and paths accept shell globs.
+type Selector struct {
+	Comms   []string       // Process names, as in /proc/<pid>/comm
+	Cmdline *regexp.Regexp // Matched against the arguments joined by spaces
+	Exes    []string       // Executable paths, as in /proc/<pid>/exe
+	UIDs    []uint32       // Effective user IDs
+}
+
+// procInfo holds the properties of a process that selectors match on
+type procInfo struct {
+	comm    string
+	cmdline string
+	exe     string
+	uid     uint32
+}
+
+// NewSelector builds a selector from command line values. Empty values
+// leave a criterion unset; UIDs may be given as numbers only.
+func NewSelector(comms []string, cmdline string, exes []string, uids []string) (Selector, error) {
+	sel := Selector{Comms: comms, Exes: exes}
+
+	if cmdline != "" {
+		re, err := regexp.Compile(cmdline)
+		if err != nil {
+			return sel, fmt.Errorf("invalid command line pattern: %w", err)
+		}
+		sel.Cmdline = re
+	}
+
+	for _, pattern := range append(append([]string(nil), comms...), exes...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return sel, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, s := range uids {
+		uid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return sel, fmt.Errorf("invalid UID %q: %w", s, err)
+		}
+		sel.UIDs = append(sel.UIDs, uint32(uid))
+	}
+	return sel, nil
+}
+
+// Empty reports whether the selector has no criteria, in which case it
+// matches nothing
+func (s Selector) Empty() bool {
+	return len(s.Comms) == 0 && s.Cmdline == nil && len(s.Exes) == 0 && len(s.UIDs) == 0
+}
+
+// needsExe reports whether matching requires the executable path, which
+// can only be read for processes we have ptrace access to
+func (s Selector) needsExe() bool {
+	return len(s.Exes) > 0
+}
+
+// matches checks a process against the selector
+func (s Selector) matches(info *procInfo) bool {
+	if s.Empty() {
+		return false
+	}
+	if len(s.Comms) > 0 && !matchAny(s.Comms, info.comm) {
+		return false
+	}
+	if s.Cmdline != nil && !s.Cmdline.MatchString(info.cmdline) {
+		return false
+	}
+	if len(s.Exes) > 0 && !matchAny(s.Exes, info.exe) {
+		return false
+	}
+	if len(s.UIDs) > 0 {
+		found := false
+		for _, uid := range s.UIDs {
+			if uid == info.uid {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny checks name against a list of shell globs
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readProcInfo reads the properties of a process from procfs. The
+// executable path is only read if exe is set.
+func readProcInfo(procRoot string, pid int32, exe bool) (*procInfo, error) {
+	dir := filepath.Join(procRoot, strconv.FormatInt(int64(pid), 10))
+	info := &procInfo{}
+
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return nil, err
+	}
+	info.comm = strings.TrimSpace(string(comm))
+
+	// Kernel threads have an empty command line
+	cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	info.cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+
+	if info.uid, err = readUID(filepath.Join(dir, "status")); err != nil {
+		return nil, err
+	}
+
+	if exe {
+		// Executables replaced on disk, e.g. by an upgrade, are marked deleted
+		path, err := os.Readlink(filepath.Join(dir, "exe"))
+		if err == nil {
+			info.exe = strings.TrimSuffix(path, " (deleted)")
+		}
+	}
+	return info, nil
+}
+
+// readUID reads the effective user ID from a /proc/<pid>/status file
+func readUID(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Uid: real effective saved filesystem
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[0] == "Uid:" {
+			uid, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid Uid line in %s: %w", path, err)
+			}
+			return uint32(uid), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no Uid line in %s", path)
+}
@@ -0,0 +1,142 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFakeProc creates the procfs entries of a process under root
+func writeFakeProc(t *testing.T, root string, pid int, comm string, args []string, exe string, uid int) {
+	t.Helper()
+	dir := filepath.Join(root, fmt.Sprint(pid))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"comm":    comm + "\n",
+		"cmdline": strings.Join(args, "\x00") + "\x00",
+		"status":  fmt.Sprintf("Name:\t%s\nUid:\t%d\t%d\t%d\t%d\n", comm, uid+1, uid, uid, uid),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(exe, filepath.Join(dir, "exe")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	root := t.TempDir()
+	writeFakeProc(t, root, 100, "nginx", []string{"nginx: worker process"}, "/usr/sbin/nginx", 33)
+	writeFakeProc(t, root, 200, "python3", []string{"python3", "-m", "http.server", "8080"}, "/usr/bin/python3.12 (deleted)", 1000)
+
+	nginx, err := readProcInfo(root, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	python, err := readProcInfo(root, 200, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if python.exe != "/usr/bin/python3.12" || python.uid != 1000 || python.cmdline != "python3 -m http.server 8080" {
+		t.Errorf("python info = %+v", python)
+	}
+
+	tests := []struct {
+		name          string
+		comms         []string
+		cmdline       string
+		exes          []string
+		uids          []string
+		nginx, python bool
+	}{
+		{"comm", []string{"nginx"}, "", nil, nil, true, false},
+		{"comm glob", []string{"py*"}, "", nil, nil, false, true},
+		{"cmdline", nil, `http\.server`, nil, nil, false, true},
+		{"exe glob", nil, "", []string{"/usr/bin/python3*"}, nil, false, true},
+		{"effective uid", nil, "", nil, []string{"33"}, true, false},
+		{"all must match", []string{"nginx"}, "", nil, []string{"1000"}, false, false},
+		{"any value", []string{"nginx", "python3"}, "", nil, nil, true, true},
+		{"empty", nil, "", nil, nil, false, false},
+	}
+	for _, tt := range tests {
+		sel, err := NewSelector(tt.comms, tt.cmdline, tt.exes, tt.uids)
+		if err != nil {
+			t.Fatalf("%s: NewSelector failed: %v", tt.name, err)
+		}
+		if got := sel.matches(nginx); got != tt.nginx {
+			t.Errorf("%s: matches(nginx) = %v, want %v", tt.name, got, tt.nginx)
+		}
+		if got := sel.matches(python); got != tt.python {
+			t.Errorf("%s: matches(python) = %v, want %v", tt.name, got, tt.python)
+		}
+	}
+
+	if _, err := NewSelector(nil, "(", nil, nil); err == nil {
+		t.Error("Expected error for invalid regular expression")
+	}
+	if _, err := NewSelector(nil, "", nil, []string{"root"}); err == nil {
+		t.Error("Expected error for non-numeric UID")
+	}
+}
+
+func TestMonitorScan(t *testing.T) {
+	root := t.TempDir()
+	writeFakeProc(t, root, 100, "nginx", []string{"nginx"}, "/usr/sbin/nginx", 33)
+	writeFakeProc(t, root, 200, "sshd", []string{"sshd"}, "/usr/sbin/sshd", 0)
+
+	mon := New()
+	mon.procRoot = root
+	filter := &fakeFilter{pids: make(map[uint32]bool)}
+	if err := mon.SetPIDFilter(filter); err != nil {
+		t.Fatal(err)
+	}
+	sel, err := NewSelector([]string{"nginx"}, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.AddSelector(sel)
+
+	mon.scan()
+	if pids := mon.GetMonitoredPIDs(); len(pids) != 1 || pids[0] != 100 || !filter.pids[100] {
+		t.Fatalf("Expected PID 100 selected, got %v", pids)
+	}
+
+	// A restarted process is picked up and the dead one dropped
+	if err := os.RemoveAll(filepath.Join(root, "100")); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeProc(t, root, 300, "nginx", []string{"nginx"}, "/usr/sbin/nginx", 33)
+	mon.checkProcesses() // Marks 100 as exited
+	mon.checkProcesses() // Drops it
+	mon.scan()
+
+	if _, err := mon.GetProcessStats(100); err == nil {
+		t.Error("Expected exited PID 100 to be dropped")
+	}
+	if filter.pids[100] {
+		t.Error("Expected PID 100 removed from filter")
+	}
+	if pids := mon.GetMonitoredPIDs(); len(pids) != 1 || pids[0] != 300 {
+		t.Errorf("Expected PID 300 selected, got %v", pids)
+	}
+
+	// A process executing another program no longer matches
+	if err := os.RemoveAll(filepath.Join(root, "300")); err != nil {
+		t.Fatal(err)
+	}
+	writeFakeProc(t, root, 300, "sh", []string{"sh"}, "/bin/sh", 33)
+	mon.scan()
+
+	if _, err := mon.GetProcessStats(300); err == nil {
+		t.Error("Expected PID 300 to be dropped once it no longer matches")
+	}
+	if filter.pids[300] {
+		t.Error("Expected PID 300 removed from filter")
+	}
+}
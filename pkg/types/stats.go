@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
@@ -9,14 +10,18 @@ import (
 // ProcessStats holds network statistics for a single process
 type ProcessStats struct {
 	PID       int32
-	Comm      string    // Process name
-	StartTime time.Time // Monitoring start time
+	Comm      string         // Process name
+	Cgroup    string         // Cgroup path below the cgroup root for rows covering a cgroup or unit
+	Container *ContainerInfo // Container the row runs in, nil for host processes
+	Group     string         // What the row groups processes by, e.g. "pod", for rows combining several
+	StartTime time.Time      // Monitoring start time
 
 	// Network statistics with mutex protection
-	mu      sync.RWMutex
-	Current NetworkStats
-	Peak    NetworkStats
-	Total   NetworkStats
+	mu       sync.RWMutex
+	Current  NetworkStats
+	Peak     NetworkStats
+	Total    NetworkStats
+	exitTime time.Time // Zero while the process is running
 }
 
 // NetworkStats holds various network metrics
@@ -29,9 +34,119 @@ type NetworkStats struct {
 	CurrentRateOut float64
 	PeakRateIn     float64
 	PeakRateOut    float64
-	TCPConnections uint32
+	TCPConnections uint32 // Currently open TCP connections
 	UDPConnections uint32
+	TCPStates      map[string]uint32 // TCP sockets per state, e.g. "ESTABLISHED"
+	IPv4           TrafficStats
+	IPv6           TrafficStats
+	Socket         TrafficStats              // Application payload at the socket layer; packets are send/receive calls
+	Retransmits    uint64                    // Retransmitted TCP segments
+	RSTIn          uint64                    // TCP resets received
+	RSTOut         uint64                    // TCP resets sent
+	SRTT           time.Duration             // Smoothed TCP round-trip time, averaged over packets
+	RTTVar         time.Duration             // TCP round-trip time variance, averaged over packets
+	Interfaces     map[string]TrafficStats   // key: interface name
+	Drops          map[string]uint64         // Dropped packets by kernel drop reason, e.g. "NO_SOCKET"
 	ActiveConns    map[string]ConnectionInfo // key: "srcIP:srcPort-dstIP:dstPort"
+	SNI            map[string]TrafficStats   // Traffic of tracked TLS connections per server name
+	DNS            []DNSQuery                // Recent DNS queries, oldest first
+	HTTP           *HTTPStats                // Plaintext HTTP/1.x traffic, if sniffed
+	Histograms     *Histograms               // Packet size and inter-arrival distributions, if tracked
+}
+
+// TrafficStats holds traffic counters for a subset of a process's traffic,
+// such as one address family or one interface
+type TrafficStats struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+// Add accumulates the counters of other into fs
+func (fs *TrafficStats) Add(other TrafficStats) {
+	fs.BytesIn += other.BytesIn
+	fs.BytesOut += other.BytesOut
+	fs.PacketsIn += other.PacketsIn
+	fs.PacketsOut += other.PacketsOut
+}
+
+// Add accumulates the statistics of other into ns, as for processes grouped
+// together. Round-trip times are averaged over the packets of both.
+func (ns *NetworkStats) Add(other NetworkStats) {
+	packets, otherPackets := ns.PacketsIn+ns.PacketsOut, other.PacketsIn+other.PacketsOut
+	if packets+otherPackets > 0 {
+		ns.SRTT = time.Duration((uint64(ns.SRTT)*packets + uint64(other.SRTT)*otherPackets) / (packets + otherPackets))
+		ns.RTTVar = time.Duration((uint64(ns.RTTVar)*packets + uint64(other.RTTVar)*otherPackets) / (packets + otherPackets))
+	}
+
+	ns.BytesIn += other.BytesIn
+	ns.BytesOut += other.BytesOut
+	ns.PacketsIn += other.PacketsIn
+	ns.PacketsOut += other.PacketsOut
+	ns.CurrentRateIn += other.CurrentRateIn
+	ns.CurrentRateOut += other.CurrentRateOut
+	ns.PeakRateIn += other.PeakRateIn
+	ns.PeakRateOut += other.PeakRateOut
+	ns.TCPConnections += other.TCPConnections
+	ns.UDPConnections += other.UDPConnections
+	ns.IPv4.Add(other.IPv4)
+	ns.IPv6.Add(other.IPv6)
+	ns.Socket.Add(other.Socket)
+	ns.Retransmits += other.Retransmits
+	ns.RSTIn += other.RSTIn
+	ns.RSTOut += other.RSTOut
+
+	for state, n := range other.TCPStates {
+		if ns.TCPStates == nil {
+			ns.TCPStates = make(map[string]uint32)
+		}
+		ns.TCPStates[state] += n
+	}
+	for name, iface := range other.Interfaces {
+		if ns.Interfaces == nil {
+			ns.Interfaces = make(map[string]TrafficStats)
+		}
+		total := ns.Interfaces[name]
+		total.Add(iface)
+		ns.Interfaces[name] = total
+	}
+	for reason, n := range other.Drops {
+		if ns.Drops == nil {
+			ns.Drops = make(map[string]uint64)
+		}
+		ns.Drops[reason] += n
+	}
+	for key, conn := range other.ActiveConns {
+		if ns.ActiveConns == nil {
+			ns.ActiveConns = make(map[string]ConnectionInfo)
+		}
+		ns.ActiveConns[key] = conn
+	}
+	for name, traffic := range other.SNI {
+		if ns.SNI == nil {
+			ns.SNI = make(map[string]TrafficStats)
+		}
+		total := ns.SNI[name]
+		total.Add(traffic)
+		ns.SNI[name] = total
+	}
+	ns.DNS = append(ns.DNS, other.DNS...)
+	if other.HTTP != nil {
+		if ns.HTTP == nil {
+			ns.HTTP = &HTTPStats{}
+		}
+		ns.HTTP.Add(other.HTTP)
+	}
+	if h := other.Histograms; h != nil {
+		if ns.Histograms == nil {
+			ns.Histograms = &Histograms{}
+		}
+		ns.Histograms.SizeIn.Add(h.SizeIn)
+		ns.Histograms.SizeOut.Add(h.SizeOut)
+		ns.Histograms.GapIn.Add(h.GapIn)
+		ns.Histograms.GapOut.Add(h.GapOut)
+	}
 }
 
 // ConnectionInfo represents an active network connection
@@ -40,9 +155,138 @@ type ConnectionInfo struct {
 	LocalAddr   string // "ip:port"
 	RemoteAddr  string // "ip:port"
 	State       string // TCP state (if applicable)
+	SNI         string // TLS server name, if a ClientHello was seen
+	BytesIn     uint64
+	BytesOut    uint64
+	PacketsIn   uint64
+	PacketsOut  uint64
+	SocketIn    uint64 // Application payload at the socket layer
+	SocketOut   uint64
+	Retransmits uint32        // Retransmitted TCP segments
+	RSTs        uint32        // TCP resets sent or received
+	SRTT        time.Duration // Latest smoothed round-trip time
+	RTTVar      time.Duration // Latest round-trip time variance
+	FirstSeen   time.Time
 	LastUpdated time.Time
 }
 
+// DNSQuery is a DNS lookup made by a process and the response to it
+type DNSQuery struct {
+	Time     time.Time // When the query was sent
+	Name     string    // Queried name, e.g. "example.com"
+	Type     string    // Query type, e.g. "AAAA"
+	RCode    string    // Response code, e.g. "NXDOMAIN", or DNSTimeout
+	Latency  time.Duration
+	Server   string // "ip:port"
+	Protocol string // "udp" or "tcp"
+}
+
+// Histogram is a log2 histogram: bucket i counts values in [2^i, 2^(i+1)),
+// and bucket 0 also counts 0. Trailing empty buckets are left out.
+type Histogram []uint64
+
+// BucketRange returns the smallest and largest value counted in bucket i
+func BucketRange(i int) (uint64, uint64) {
+	if i == 0 {
+		return 0, 1
+	}
+	return 1 << i, 1<<(i+1) - 1
+}
+
+// Add accumulates the counts of other into h
+func (h *Histogram) Add(other Histogram) {
+	for len(*h) < len(other) {
+		*h = append(*h, 0)
+	}
+	for i, n := range other {
+		(*h)[i] += n
+	}
+}
+
+// Histograms holds the distributions of a process's packets per direction
+type Histograms struct {
+	SizeIn  Histogram // Packet sizes in bytes
+	SizeOut Histogram
+	GapIn   Histogram // Gaps between consecutive packets in microseconds
+	GapOut  Histogram
+}
+
+// HTTPStats summarizes the plaintext HTTP/1.x requests and responses of a
+// process, whether it is the client or the server
+type HTTPStats struct {
+	Requests  uint64
+	Responses uint64
+	Methods   map[string]uint64        // Requests per method, e.g. "GET"
+	Statuses  map[string]uint64        // Responses per status code, e.g. "404"
+	Paths     map[string]HTTPPathStats // Requests per path prefix, e.g. "/api/v1"
+}
+
+// Add accumulates the counters of other into hs
+func (hs *HTTPStats) Add(other *HTTPStats) {
+	hs.Requests += other.Requests
+	hs.Responses += other.Responses
+	if hs.Methods == nil {
+		hs.Methods = make(map[string]uint64)
+	}
+	for method, n := range other.Methods {
+		hs.Methods[method] += n
+	}
+	if hs.Statuses == nil {
+		hs.Statuses = make(map[string]uint64)
+	}
+	for status, n := range other.Statuses {
+		hs.Statuses[status] += n
+	}
+	if hs.Paths == nil {
+		hs.Paths = make(map[string]HTTPPathStats)
+	}
+	for path, p := range other.Paths {
+		total := hs.Paths[path]
+		total.Requests += p.Requests
+		total.Bytes += p.Bytes
+		hs.Paths[path] = total
+	}
+}
+
+// HTTPPathStats counts the requests to a path prefix. Bytes covers requests
+// and their responses on the wire, once the next request on the connection
+// starts or the connection ends.
+type HTTPPathStats struct {
+	Requests uint64
+	Bytes    uint64
+}
+
+// DNSTimeout is the response code of queries that were never answered
+const DNSTimeout = "TIMEOUT"
+
+// ContainerInfo describes a container. Only ID and Runtime are known for
+// containers the runtime could not be asked about.
+type ContainerInfo struct {
+	ID      string // Full container ID
+	Name    string
+	Image   string
+	Runtime string // "docker", "containerd", "cri-o" or "podman"; empty if unknown
+	Labels  map[string]string
+	Pod     *PodInfo // Kubernetes pod the container belongs to, nil outside Kubernetes
+}
+
+// PodInfo describes a Kubernetes pod. Only UID is known for pods the runtime
+// could not be asked about.
+type PodInfo struct {
+	UID       string
+	Name      string
+	Namespace string
+	Labels    map[string]string
+}
+
+// ShortID returns the abbreviated container ID, as shown by container tools
+func (c *ContainerInfo) ShortID() string {
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
 // NewProcessStats creates a new ProcessStats instance
 func NewProcessStats(pid int32, comm string) *ProcessStats {
 	return &ProcessStats{
@@ -61,11 +305,50 @@ func NewProcessStats(pid int32, comm string) *ProcessStats {
 	}
 }
 
-// Update atomically updates current statistics and updates peaks if necessary
+// GroupStats combines the statistics of the processes in a group into one
+// row, named name and keyed by pid. Rates and peak rates add up. The group
+// has exited once all its members have.
+func GroupStats(pid int32, group, name string, members []*ProcessStats) *ProcessStats {
+	gs := NewProcessStats(pid, name)
+	gs.Group = group
+
+	exited := len(members) > 0
+	for i, member := range members {
+		current, peak, total := member.GetStats()
+		gs.Current.Add(current)
+		gs.Peak.Add(peak)
+		gs.Total.Add(total)
+
+		if i == 0 || member.StartTime.Before(gs.StartTime) {
+			gs.StartTime = member.StartTime
+		}
+		exitTime, ok := member.Exited()
+		exited = exited && ok
+		if exitTime.After(gs.exitTime) {
+			gs.exitTime = exitTime
+		}
+	}
+	if !exited {
+		gs.exitTime = time.Time{}
+	}
+
+	sort.SliceStable(gs.Current.DNS, func(i, j int) bool {
+		return gs.Current.DNS[i].Time.Before(gs.Current.DNS[j].Time)
+	})
+	return gs
+}
+
+// Update atomically updates current statistics and updates peaks if
+// necessary. Updates after Exit are ignored, so that a late poll cannot
+// replace the final statistics.
 func (ps *ProcessStats) Update(stats NetworkStats) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
+	if !ps.exitTime.IsZero() {
+		return
+	}
+
 	ps.Current = stats
 
 	// Update peak rates
@@ -81,6 +364,38 @@ func (ps *ProcessStats) Update(stats NetworkStats) {
 	ps.Total.BytesOut += stats.BytesOut
 	ps.Total.PacketsIn += stats.PacketsIn
 	ps.Total.PacketsOut += stats.PacketsOut
+	// The per-family, socket, retransmit, reset, interface and drop counters
+	// of the kernel are cumulative already; they are kept in Current rather
+	// than added up
+}
+
+// Exit records the final statistics of a process that has exited. Later
+// calls replace the final statistics but keep the original exit time.
+func (ps *ProcessStats) Exit(final NetworkStats) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	final.CurrentRateIn = 0
+	final.CurrentRateOut = 0
+	ps.Current = final
+	if ps.exitTime.IsZero() {
+		ps.exitTime = time.Now()
+	}
+}
+
+// Exited reports whether the process has exited, and when
+func (ps *ProcessStats) Exited() (time.Time, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.exitTime, !ps.exitTime.IsZero()
+}
+
+// Runtime returns how long the process has been monitored, up to its exit
+func (ps *ProcessStats) Runtime() time.Duration {
+	if exitTime, ok := ps.Exited(); ok {
+		return exitTime.Sub(ps.StartTime)
+	}
+	return time.Since(ps.StartTime)
 }
 
 // GetStats safely retrieves current statistics
@@ -134,3 +449,30 @@ func FormatBytes(bytes uint64) string {
 		return fmt.Sprintf("%d B", bytes)
 	}
 }
+
+// ConnEventType identifies a connection lifecycle event
+type ConnEventType string
+
+const (
+	ConnConnect ConnEventType = "connect"
+	ConnAccept  ConnEventType = "accept"
+	ConnClose   ConnEventType = "close"
+)
+
+// ConnEvent is a lifecycle event of a connection of a monitored process
+type ConnEvent struct {
+	Time       time.Time
+	Type       ConnEventType
+	PID        int32
+	Comm       string // Process name
+	Protocol   string // "tcp"
+	LocalAddr  string // "ip:port"
+	RemoteAddr string // "ip:port"
+
+	// Totals over the lifetime of the connection, set on close
+	Duration   time.Duration
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
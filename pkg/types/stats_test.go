@@ -107,6 +107,23 @@ func TestProcessStatsUpdate(t *testing.T) {
 	}
 }
 
+func TestProcessStatsUpdateAfterExit(t *testing.T) {
+	stats := NewProcessStats(1234, "test-process")
+	stats.Update(NetworkStats{BytesIn: 1000, CurrentRateIn: 100.0})
+	stats.Exit(NetworkStats{BytesIn: 1500})
+
+	// A poll racing with the exit must not replace the final statistics
+	stats.Update(NetworkStats{BytesIn: 10, CurrentRateIn: 5.0})
+
+	current, _, total := stats.GetStats()
+	if current.BytesIn != 1500 || current.CurrentRateIn != 0 {
+		t.Errorf("Expected final BytesIn 1500 at no rate, got %d at %.2f", current.BytesIn, current.CurrentRateIn)
+	}
+	if total.BytesIn != 1000 {
+		t.Errorf("Expected total BytesIn 1000, got %d", total.BytesIn)
+	}
+}
+
 func TestFormatRate(t *testing.T) {
 	const (
 		_  = iota
@@ -197,3 +214,37 @@ func TestConnectionInfo(t *testing.T) {
 		t.Errorf("Expected last updated %v, got %v", conn.LastUpdated, savedConn.LastUpdated)
 	}
 }
+
+func TestProcessStatsFamilyCounters(t *testing.T) {
+	stats := NewProcessStats(1234, "test-process")
+
+	update := NetworkStats{
+		BytesIn:     1500,
+		BytesOut:    700,
+		IPv4:        TrafficStats{BytesIn: 1000, BytesOut: 500, PacketsIn: 10, PacketsOut: 5},
+		IPv6:        TrafficStats{BytesIn: 500, BytesOut: 200, PacketsIn: 4, PacketsOut: 2},
+		Retransmits: 3,
+		RSTIn:       1,
+		Interfaces:  map[string]TrafficStats{"eth0": {BytesIn: 1500, BytesOut: 700}},
+		Drops:       map[string]uint64{"NO_SOCKET": 1},
+		ActiveConns: make(map[string]ConnectionInfo),
+	}
+
+	// Cumulative kernel counters polled twice must not add up
+	stats.Update(update)
+	stats.Update(update)
+	current, _, total := stats.GetStats()
+
+	if current.IPv4 != update.IPv4 || current.IPv6 != update.IPv6 {
+		t.Errorf("Unexpected family counters: %+v, %+v", current.IPv4, current.IPv6)
+	}
+	if current.Retransmits != 3 || current.RSTIn != 1 {
+		t.Errorf("Unexpected retransmits %d and resets %d", current.Retransmits, current.RSTIn)
+	}
+	if current.Interfaces["eth0"].BytesIn != 1500 || current.Drops["NO_SOCKET"] != 1 {
+		t.Errorf("Unexpected interface counters %+v and drops %v", current.Interfaces, current.Drops)
+	}
+	if total.IPv4 != (TrafficStats{}) || total.Retransmits != 0 || total.Interfaces != nil || total.Drops != nil {
+		t.Errorf("Expected no cumulative counters in totals, got %+v", total)
+	}
+}